@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var alertWebhookFlag = flag.String("alert-webhook", "", "With -alert-rule, POST a JSON document to this URL when an alert fires or resolves")
+
+// alertOperators are the comparisons of alert rules. Two-character operators
+// come first, so that ">=" is not read as ">".
+var alertOperators = []string{">=", "<=", "==", "!=", ">", "<"}
+
+// alertRule fires when a field of a measurement has met a condition for the
+// given duration. The duration is tracked across runs in the state file.
+type alertRule struct {
+	name        string
+	measurement string
+	field       string
+	operator    string
+	threshold   float64
+	duration    time.Duration
+	text        string
+}
+
+func (r alertRule) matches(value float64) bool {
+	switch r.operator {
+	case ">=":
+		return value >= r.threshold
+	case "<=":
+		return value <= r.threshold
+	case "==":
+		return value == r.threshold
+	case "!=":
+		return value != r.threshold
+	case ">":
+		return value > r.threshold
+	case "<":
+		return value < r.threshold
+	}
+	return false
+}
+
+type alertRules []alertRule
+
+func (r *alertRules) String() string {
+	var rules []string
+	for _, rule := range *r {
+		rules = append(rules, rule.text)
+	}
+	return strings.Join(rules, ", ")
+}
+
+// Set adds a rule in "name:measurement.field>threshold for duration" format,
+// where the duration is optional. The syncthing_ prefix of the measurement
+// can be left out.
+func (r *alertRules) Set(value string) error {
+	rule, err := parseAlertRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+func parseAlertRule(value string) (alertRule, error) {
+	format := fmt.Errorf("alert rule must be in \"name:measurement.field>threshold [for duration]\" format")
+	rule := alertRule{text: value}
+	i := strings.Index(value, ":")
+	if i <= 0 {
+		return rule, format
+	}
+	rule.name = strings.TrimSpace(value[:i])
+	condition := value[i+1:]
+	if i := strings.Index(condition, " for "); i >= 0 {
+		duration, err := time.ParseDuration(strings.TrimSpace(condition[i+len(" for "):]))
+		if err != nil {
+			return rule, fmt.Errorf("invalid duration in alert rule %s: %s", rule.name, err)
+		}
+		rule.duration = duration
+		condition = condition[:i]
+	}
+	for _, operator := range alertOperators {
+		i := strings.Index(condition, operator)
+		if i < 0 {
+			continue
+		}
+		rule.operator = operator
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(condition[i+len(operator):]), 64)
+		if err != nil {
+			return rule, fmt.Errorf("invalid threshold in alert rule %s: %s", rule.name, err)
+		}
+		rule.threshold = threshold
+		condition = strings.TrimSpace(condition[:i])
+		break
+	}
+	j := strings.LastIndex(condition, ".")
+	if rule.operator == "" || j <= 0 || j == len(condition)-1 {
+		return rule, format
+	}
+	rule.measurement, rule.field = condition[:j], condition[j+1:]
+	if !strings.HasPrefix(rule.measurement, "syncthing_") {
+		rule.measurement = "syncthing_" + rule.measurement
+	}
+	return rule, nil
+}
+
+var alertRulesFlag alertRules
+
+func init() {
+	flag.Var(&alertRulesFlag, "alert-rule", "With -state-file, alert when a field meets a condition, in \"name:measurement.field>threshold [for duration]\" format, for example \"behind:folder.need_bytes>1e9 for 30m\". Operators are >, >=, <, <=, == and !=. Can be repeated.")
+}
+
+// alertState is the state of a rule on one series.
+type alertState struct {
+	// Since is when the condition was first met.
+	Since  time.Time `json:"since"`
+	Firing bool      `json:"firing"`
+	Seen   time.Time `json:"seen"`
+}
+
+// alertNotification is sent to the notifiers when an alert fires or
+// resolves. It is also the JSON document posted to -alert-webhook.
+type alertNotification struct {
+	Rule        string            `json:"rule"`
+	Status      string            `json:"status"`
+	Condition   string            `json:"condition"`
+	Measurement string            `json:"measurement"`
+	Field       string            `json:"field"`
+	Value       float64           `json:"value"`
+	Tags        map[string]string `json:"tags"`
+	Since       time.Time         `json:"since"`
+	// Instance identifies the Syncthing instance, like in the state file.
+	Instance string `json:"instance"`
+	// Key identifies the alert across runs, for notifiers that resolve
+	// alerts they triggered earlier.
+	Key string `json:"key"`
+}
+
+// summary describes the alert in one line, for notifiers that send text.
+func (a alertNotification) summary() string {
+	var tags []string
+	for key, value := range a.Tags {
+		tags = append(tags, key+"="+value)
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("%s %s: %s %s=%g (%s)", a.Rule, a.Status, a.Measurement, a.Field, a.Value, strings.Join(tags, ", "))
+}
+
+// dedupKey is a short form of Key for services that limit its length.
+func (a alertNotification) dedupKey() string {
+	hash := fnv.New64a()
+	hash.Write([]byte(a.Key))
+	return fmt.Sprintf("syncthing-%016x", hash.Sum64())
+}
+
+// notifier delivers alert notifications.
+type notifier func(alert alertNotification) error
+
+var alertNotifiers []notifier
+
+var alertClient = &http.Client{
+	Timeout: 10 * time.Second,
+}
+
+// postJSON posts document to a notification service.
+func postJSON(url string, headers map[string]string, document interface{}) error {
+	body, err := json.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return post(url, "application/json", headers, body)
+}
+
+func post(url string, contentType string, headers map[string]string, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create HTTP request: %s", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := alertClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return nil
+}
+
+func sendWebhook(alert alertNotification) error {
+	return postJSON(*alertWebhookFlag, nil, alert)
+}
+
+// evaluateAlerts checks a series against the alert rules. Notifications are
+// queued and sent by sendAlerts once the instance has been collected.
+func (inst *instance) evaluateAlerts(measurement string, tags []tag, fields []field) {
+	for _, rule := range alertRulesFlag {
+		if rule.measurement != measurement {
+			continue
+		}
+		for _, f := range fields {
+			if f.key != rule.field {
+				continue
+			}
+			value, ok := toFloat(f.value)
+			if !ok {
+				continue
+			}
+			inst.evaluateAlert(rule, measurement, tags, value)
+		}
+	}
+}
+
+func (inst *instance) evaluateAlert(rule alertRule, measurement string, tags []tag, value float64) {
+	key := rule.name + "|" + seriesKey(measurement, tags)
+	now := time.Now()
+	var notification *alertNotification
+	inst.updateState(func(instState *instanceState) {
+		if instState.Alerts == nil {
+			instState.Alerts = make(map[string]*alertState)
+		}
+		alert, ok := instState.Alerts[key]
+		if !rule.matches(value) {
+			if ok && alert.Firing {
+				notification = &alertNotification{Status: "resolved", Since: alert.Since}
+			}
+			delete(instState.Alerts, key)
+			return
+		}
+		if !ok {
+			alert = &alertState{Since: now}
+			instState.Alerts[key] = alert
+		}
+		alert.Seen = now
+		if !alert.Firing && now.Sub(alert.Since) >= rule.duration {
+			alert.Firing = true
+			notification = &alertNotification{Status: "firing", Since: alert.Since}
+		}
+	})
+	if notification == nil {
+		return
+	}
+	notification.Rule = rule.name
+	notification.Condition = rule.text[strings.Index(rule.text, ":")+1:]
+	notification.Measurement = measurement
+	notification.Field = rule.field
+	notification.Value = value
+	notification.Tags = make(map[string]string)
+	for _, t := range append(append([]tag{}, inst.tags...), tags...) {
+		if t.value != "" {
+			notification.Tags[t.key] = t.value
+		}
+	}
+	notification.Instance = inst.stateKey()
+	notification.Key = inst.stateKey() + "|" + key
+	inst.alertsMutex.Lock()
+	inst.alerts = append(inst.alerts, *notification)
+	inst.alertsMutex.Unlock()
+}
+
+// sendAlerts sends the notifications queued on this run, and forgets alerts
+// of series that have not been seen for a day, such as removed folders.
+func (inst *instance) sendAlerts() {
+	if len(alertRulesFlag) == 0 {
+		return
+	}
+	now := time.Now()
+	inst.updateState(func(instState *instanceState) {
+		for key, alert := range instState.Alerts {
+			if now.Sub(alert.Seen) > 24*time.Hour {
+				delete(instState.Alerts, key)
+			}
+		}
+	})
+	inst.alertsMutex.Lock()
+	alerts := inst.alerts
+	inst.alerts = nil
+	inst.alertsMutex.Unlock()
+	for _, alert := range alerts {
+		for _, notify := range alertNotifiers {
+			err := notify(alert)
+			if err != nil {
+				os.Stderr.Write([]byte(fmt.Sprintf("Unable to send alert %s: %s\n", alert.Rule, err)))
+			}
+		}
+	}
+}
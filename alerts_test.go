@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAlertRule(t *testing.T) {
+	tests := []struct {
+		value string
+		want  alertRule
+		err   bool
+	}{
+		{
+			value: "behind:folder.need_bytes>1e9 for 30m",
+			want:  alertRule{name: "behind", measurement: "syncthing_folder", field: "need_bytes", operator: ">", threshold: 1e9, duration: 30 * time.Minute},
+		},
+		{
+			value: "offline:syncthing_connection.connected == 0 for 12h",
+			want:  alertRule{name: "offline", measurement: "syncthing_connection", field: "connected", operator: "==", threshold: 0, duration: 12 * time.Hour},
+		},
+		{
+			value: "low:folder_disk.free_vs_need_ratio<=1.5",
+			want:  alertRule{name: "low", measurement: "syncthing_folder_disk", field: "free_vs_need_ratio", operator: "<=", threshold: 1.5},
+		},
+		{value: "folder.need_bytes>1", err: true},
+		{value: "behind:need_bytes>1", err: true},
+		{value: "behind:folder.need_bytes", err: true},
+		{value: "behind:folder.need_bytes>lots", err: true},
+		{value: "behind:folder.need_bytes>1 for ever", err: true},
+	}
+	for _, test := range tests {
+		rule, err := parseAlertRule(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: no error", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.value, err)
+			continue
+		}
+		test.want.text = test.value
+		if rule != test.want {
+			t.Errorf("%q: got %+v, want %+v", test.value, rule, test.want)
+		}
+	}
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	tests := []struct {
+		operator string
+		value    float64
+		want     bool
+	}{
+		{">", 2, true},
+		{">", 1, false},
+		{">=", 1, true},
+		{"<", 0, true},
+		{"<=", 2, false},
+		{"==", 1, true},
+		{"!=", 1, false},
+	}
+	for _, test := range tests {
+		rule := alertRule{operator: test.operator, threshold: 1}
+		if rule.matches(test.value) != test.want {
+			t.Errorf("%g %s 1: got %v, want %v", test.value, test.operator, !test.want, test.want)
+		}
+	}
+}
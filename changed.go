@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+)
+
+var onlyChangedFlag = flag.Bool("only-changed", false, "With -state-file, emit a series only when its fields changed since it was last emitted, or -keepalive has passed")
+var keepaliveFlag = flag.Duration("keepalive", 10*time.Minute, "With -only-changed, emit unchanged series again after this long")
+
+// seriesKey identifies a series by its measurement and tags.
+func seriesKey(measurement string, tags []tag) string {
+	sorted := make([]tag, len(tags))
+	copy(sorted, tags)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	var key bytes.Buffer
+	key.WriteString(measurement)
+	for _, t := range sorted {
+		key.WriteString("," + t.key + "=" + t.value)
+	}
+	return key.String()
+}
+
+// elapsedTimeFields change on every run only because time passes, or vary
+// from request to request. They are left out when comparing series.
+var elapsedTimeFields = map[string]bool{
+	"uptime":                    true,
+	"seconds_in_state":          true,
+	"connection_uptime_seconds": true,
+	"seconds_since_attempt":     true,
+	"rescan_overdue_seconds":    true,
+	"response_time":             true,
+	"max_response_time":         true,
+}
+
+func isElapsedTimeField(key string) bool {
+	return elapsedTimeFields[key] || strings.HasSuffix(key, "_seconds_ago")
+}
+
+func fieldsHash(fields []field) uint64 {
+	var line bytes.Buffer
+	for _, f := range fields {
+		if isElapsedTimeField(f.key) {
+			continue
+		}
+		line.WriteString(f.key)
+		line.WriteByte('=')
+		appendValue(&line, f.value)
+		line.WriteByte(',')
+	}
+	hash := fnv.New64a()
+	hash.Write(line.Bytes())
+	return hash.Sum64()
+}
+
+// changedSinceEmitted tells whether a series has to be emitted with
+// -only-changed, and records it as emitted if so. Fields that count time,
+// like uptime or seconds since something happened, are not compared, and are
+// emitted only together with the rest of the series.
+func (inst *instance) changedSinceEmitted(measurement string, tags []tag, fields []field) bool {
+	key := seriesKey(measurement, tags)
+	hash := fieldsHash(fields)
+	now := time.Now()
+	changed := true
+	inst.updateState(func(instState *instanceState) {
+		if instState.Series == nil {
+			instState.Series = make(map[string]*seriesState)
+		}
+		previous, ok := instState.Series[key]
+		if ok && previous.Hash == hash && now.Sub(previous.At) < *keepaliveFlag {
+			changed = false
+			return
+		}
+		instState.Series[key] = &seriesState{Hash: hash, At: now}
+	})
+	return changed
+}
+
+// pruneSeries forgets series that have not been emitted for a while, such as
+// folders that have been removed.
+func (inst *instance) pruneSeries() {
+	now := time.Now()
+	inst.updateState(func(instState *instanceState) {
+		for key, series := range instState.Series {
+			if now.Sub(series.At) > 2**keepaliveFlag {
+				delete(instState.Series, key)
+			}
+		}
+	})
+}
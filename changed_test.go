@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFieldsHash(t *testing.T) {
+	base := []field{{"need_bytes", int64(10)}, {"state", "idle"}, {"uptime", 100}}
+	tests := []struct {
+		name   string
+		fields []field
+		same   bool
+	}{
+		{"identical", []field{{"need_bytes", int64(10)}, {"state", "idle"}, {"uptime", 100}}, true},
+		{"elapsed time", []field{{"need_bytes", int64(10)}, {"state", "idle"}, {"uptime", 160}}, true},
+		{"seconds ago", append(base, field{"last_scan_seconds_ago", 5}), true},
+		{"value", []field{{"need_bytes", int64(11)}, {"state", "idle"}, {"uptime", 100}}, false},
+		{"type", []field{{"need_bytes", "10"}, {"state", "idle"}, {"uptime", 100}}, false},
+		{"added field", append(base, field{"need_files", 1}), false},
+	}
+	for _, test := range tests {
+		if same := fieldsHash(test.fields) == fieldsHash(base); same != test.same {
+			t.Errorf("%s: got same hash %v, want %v", test.name, same, test.same)
+		}
+	}
+}
+
+func TestChangedSinceEmitted(t *testing.T) {
+	inst := &instance{servers: []string{"http://changed.test"}}
+	defer func() {
+		stateMutex.Lock()
+		delete(state, inst.stateKey())
+		stateMutex.Unlock()
+	}()
+	folder := []tag{{"folder_id", "abcd-1234"}}
+	other := []tag{{"folder_id", "efgh-5678"}}
+	steps := []struct {
+		name   string
+		tags   []tag
+		fields []field
+		age    time.Duration
+		want   bool
+	}{
+		{"first", folder, []field{{"need_bytes", 10}, {"uptime", 1}}, 0, true},
+		{"unchanged", folder, []field{{"need_bytes", 10}, {"uptime", 2}}, 0, false},
+		{"other series", other, []field{{"need_bytes", 10}}, 0, true},
+		{"changed", folder, []field{{"need_bytes", 20}}, 0, true},
+		{"keepalive", folder, []field{{"need_bytes", 20}}, *keepaliveFlag, true},
+		{"after keepalive", folder, []field{{"need_bytes", 20}}, 0, false},
+	}
+	for _, step := range steps {
+		if step.age > 0 {
+			inst.updateState(func(instState *instanceState) {
+				instState.Series[seriesKey("syncthing_folder", step.tags)].At = time.Now().Add(-step.age)
+			})
+		}
+		if got := inst.changedSinceEmitted("syncthing_folder", step.tags, step.fields); got != step.want {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+	}
+}
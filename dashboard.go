@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var datasourceFlag = flag.String("datasource", "influxql", "Query language of the dashboard generated with the dashboard subcommand: influxql, flux or prometheus")
+
+// dashboardPanel describes a panel in terms of the default output schema.
+// The names are translated to the configured schema when generating.
+type dashboardPanel struct {
+	title       string
+	measurement string
+	field       string
+	legendTag   string
+	rate        bool
+}
+
+var dashboardPanels = []dashboardPanel{
+	{"Syncthing up", "syncthing_up", "up", "", false},
+	{"Folder need", "syncthing_folder", "need_bytes", "folder", false},
+	{"Folder completion", "syncthing_folder", "completion_pct", "folder", false},
+	{"Folder state", "syncthing_folder", "state", "folder", false},
+	{"Folder errors", "syncthing_folder", "pull_errors", "folder", false},
+	{"Device last seen", "syncthing_device", "last_seen_seconds_ago", "device", false},
+	{"Download rate", "syncthing_connection", "in_bytes", "connection", true},
+	{"Upload rate", "syncthing_connection", "out_bytes", "connection", true},
+	{"CPU usage", "syncthing_system", "cpu_percent", "", false},
+	{"Memory", "syncthing_system", "sys_bytes", "", false},
+}
+
+// Grafana units of byte fields for -byte-unit.
+var grafanaByteUnits = map[string]string{"B": "bytes", "KiB": "kbytes", "MiB": "mbytes", "GiB": "gbytes"}
+var grafanaRateUnits = map[string]string{"B": "Bps", "KiB": "KBs", "MiB": "MBs", "GiB": "GBs"}
+
+// schemaField returns the name of a field in the output, after -byte-unit
+// and -rename.
+func schemaField(name string) string {
+	return rename("field", scaleByteFields([]field{{name, 0}})[0].key)
+}
+
+// legendTag returns the tag that names the folder, device or connection of a
+// series, following -folder-tag and -tags-as-fields.
+func legendTag(kind string) string {
+	switch kind {
+	case "folder":
+		if *folderTagFlag == "id" {
+			return rename("tag", "folder_id")
+		}
+		return rename("tag", "folder_label")
+	case "device":
+		for _, name := range strings.Split(*tagsAsFieldsFlag, ",") {
+			if strings.TrimSpace(name) == "device_name" {
+				return rename("tag", "device_id")
+			}
+		}
+		return rename("tag", "device_name")
+	case "connection":
+		return rename("tag", "client_id")
+	}
+	return ""
+}
+
+func panelUnit(panel dashboardPanel) string {
+	switch {
+	case isByteField(panel.field) && panel.rate:
+		return grafanaRateUnits[*byteUnitFlag]
+	case isByteField(panel.field):
+		return grafanaByteUnits[*byteUnitFlag]
+	case strings.HasSuffix(panel.field, "_seconds_ago"):
+		return "s"
+	case strings.HasSuffix(panel.field, "_pct") || strings.HasSuffix(panel.field, "_percent"):
+		return "percent"
+	}
+	return "short"
+}
+
+func panelTarget(panel dashboardPanel) map[string]interface{} {
+	measurement := rename("measurement", panel.measurement)
+	fieldName := schemaField(panel.field)
+	tagName := legendTag(panel.legendTag)
+	switch *datasourceFlag {
+	case "flux":
+		query := fmt.Sprintf("from(bucket: \"${bucket}\")\n  |> range(start: v.timeRangeStart, stop: v.timeRangeStop)\n  |> filter(fn: (r) => r._measurement == %q and r._field == %q)\n  |> aggregateWindow(every: v.windowPeriod, fn: last, createEmpty: false)", measurement, fieldName)
+		if panel.rate {
+			query += "\n  |> derivative(unit: 1s, nonNegative: true)"
+		}
+		return map[string]interface{}{"refId": "A", "query": query}
+	case "prometheus":
+		// The Telegraf Prometheus output names metrics measurement_field.
+		expr := measurement + "_" + fieldName
+		if panel.rate {
+			expr = fmt.Sprintf("rate(%s[5m])", expr)
+		}
+		target := map[string]interface{}{"refId": "A", "expr": expr}
+		if tagName != "" {
+			target["legendFormat"] = "{{" + tagName + "}}"
+		}
+		return target
+	default:
+		selection := fmt.Sprintf("last(%q)", fieldName)
+		if panel.rate {
+			selection = fmt.Sprintf("non_negative_derivative(%s, 1s)", selection)
+		}
+		query := fmt.Sprintf("SELECT %s FROM %q WHERE $timeFilter GROUP BY time($__interval)", selection, measurement)
+		target := map[string]interface{}{"refId": "A", "rawQuery": true, "resultFormat": "time_series"}
+		if tagName != "" {
+			query += fmt.Sprintf(", %q", tagName)
+			target["alias"] = "$tag_" + tagName
+		}
+		target["query"] = query + " fill(null)"
+		return target
+	}
+}
+
+func generateDashboard() map[string]interface{} {
+	var panels []interface{}
+	for i, panel := range dashboardPanels {
+		panels = append(panels, map[string]interface{}{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      panel.title,
+			"datasource": "${datasource}",
+			"gridPos":    map[string]int{"x": (i % 2) * 12, "y": (i / 2) * 8, "w": 12, "h": 8},
+			"targets":    []interface{}{panelTarget(panel)},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": panelUnit(panel)},
+				"overrides": []interface{}{},
+			},
+		})
+	}
+	datasourceType := "influxdb"
+	if *datasourceFlag == "prometheus" {
+		datasourceType = "prometheus"
+	}
+	variables := []interface{}{
+		map[string]interface{}{"name": "datasource", "type": "datasource", "query": datasourceType},
+	}
+	if *datasourceFlag == "flux" {
+		variables = append(variables, map[string]interface{}{"name": "bucket", "type": "textbox", "query": "telegraf"})
+	}
+	return map[string]interface{}{
+		"title":         "Syncthing",
+		"schemaVersion": 27,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating":    map[string]interface{}{"list": variables},
+		"panels":        panels,
+	}
+}
+
+// runDashboard implements the dashboard subcommand, which prints a Grafana
+// dashboard for the measurements as configured by the given flags.
+func runDashboard(args []string) int {
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		return 2
+	}
+	if *datasourceFlag != "influxql" && *datasourceFlag != "flux" && *datasourceFlag != "prometheus" {
+		fmt.Println("Invalid datasource")
+		return 1
+	}
+	if _, ok := byteUnits[*byteUnitFlag]; !ok {
+		fmt.Println("Invalid byte unit")
+		return 1
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(generateDashboard())
+	if err != nil {
+		fmt.Printf("Unable to generate dashboard: %s\n", err)
+		return 1
+	}
+	return 0
+}
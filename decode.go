@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var strictFlag = flag.Bool("strict", false, "Warn on stderr about fields the collector uses that are missing from API responses, to detect API changes in new Syncthing versions")
+var debugFlag = flag.Bool("debug", false, "Log unknown and missing fields in API responses to stderr")
+
+// decodeResponse decodes a JSON response from Syncthing into target. Unknown
+// fields are ignored, as the types only model the fields the collector uses
+// and Syncthing adds fields in new versions. With -strict, fields missing from
+// the response are logged as warnings, as they would otherwise be emitted as
+// zeros. -debug logs the unknown fields as well. Neither fails the request.
+func decodeResponse(resp *http.Response, target interface{}) error {
+	if !*strictFlag && !*debugFlag {
+		return json.NewDecoder(resp.Body).Decode(target)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(body, target)
+	if err != nil {
+		return err
+	}
+	var raw interface{}
+	if json.Unmarshal(body, &raw) != nil {
+		return nil
+	}
+	targetType := reflect.TypeOf(target).Elem()
+	for _, missing := range missingFields(targetType, raw, "") {
+		os.Stderr.Write([]byte(fmt.Sprintf("Warning: %s: missing field %s\n", resp.Request.URL.Path, missing)))
+	}
+	if *debugFlag {
+		for _, unknown := range unknownFields(targetType, raw, "") {
+			os.Stderr.Write([]byte(fmt.Sprintf("Debug: %s: unknown field %s\n", resp.Request.URL.Path, unknown)))
+		}
+	}
+	return nil
+}
+
+// jsonFields maps the JSON names of the fields of a struct type to their
+// types.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" || (field.PkgPath != "" && !field.Anonymous) {
+			continue
+		}
+		if name == "" && field.Anonymous && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedType := range jsonFields(field.Type) {
+				fields[embeddedName] = embeddedType
+			}
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+// unknownFields lists the fields of the decoded JSON value that the type does
+// not have. Slices and maps are checked through their first element.
+func unknownFields(t reflect.Type, value interface{}, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var unknown []string
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := jsonFields(t)
+		for name, fieldValue := range object {
+			fieldType, ok := fields[name]
+			if !ok {
+				unknown = append(unknown, prefix+name)
+				continue
+			}
+			unknown = append(unknown, unknownFields(fieldType, fieldValue, prefix+name+".")...)
+		}
+		sort.Strings(unknown)
+	case reflect.Slice:
+		if array, ok := value.([]interface{}); ok && len(array) > 0 {
+			unknown = unknownFields(t.Elem(), array[0], prefix)
+		}
+	case reflect.Map:
+		if object, ok := value.(map[string]interface{}); ok && len(object) > 0 {
+			key := firstKey(object)
+			return unknownFields(t.Elem(), object[key], prefix+key+".")
+		}
+	}
+	return unknown
+}
+
+// missingFields lists the fields of a struct type not present in the decoded
+// JSON value. Slices and maps are checked through their first element.
+func missingFields(t reflect.Type, value interface{}, prefix string) []string {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	var missing []string
+	switch t.Kind() {
+	case reflect.Struct:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for name, fieldType := range jsonFields(t) {
+			fieldValue, ok := object[name]
+			if !ok {
+				missing = append(missing, prefix+name)
+				continue
+			}
+			missing = append(missing, missingFields(fieldType, fieldValue, prefix+name+".")...)
+		}
+		sort.Strings(missing)
+	case reflect.Slice:
+		if array, ok := value.([]interface{}); ok && len(array) > 0 {
+			missing = missingFields(t.Elem(), array[0], prefix)
+		}
+	case reflect.Map:
+		if object, ok := value.(map[string]interface{}); ok && len(object) > 0 {
+			key := firstKey(object)
+			return missingFields(t.Elem(), object[key], prefix+key+".")
+		}
+	}
+	return missing
+}
+
+// firstKey returns the smallest key of a JSON object, so that the same
+// element is checked on every run.
+func firstKey(object map[string]interface{}) string {
+	var first string
+	for key := range object {
+		if first == "" || key < first {
+			first = key
+		}
+	}
+	return first
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fixtureResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(body)),
+		Request:    &http.Request{URL: &url.URL{Path: "/rest/fixture"}},
+	}
+}
+
+// Counters above 4 GiB must survive decoding and formatting on every
+// platform, including those where int is 32 bits.
+func TestLargeFolderCounters(t *testing.T) {
+	var stats FolderStats
+	err := decodeResponse(fixtureResponse(`{
+		"globalBytes": 6442450944,
+		"inSyncBytes": 5368709120,
+		"localBytes": 8796093022208,
+		"needBytes": 4294967296,
+		"globalFiles": 4294967297,
+		"needTotalItems": 2147483648
+	}`), &stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var line bytes.Buffer
+	appendLine(&line, "syncthing_folder", []tag{{"folder_id", "abcd-1234"}}, []field{
+		{"global_bytes", stats.GlobalBytes},
+		{"insync_bytes", stats.InSyncBytes},
+		{"local_bytes", stats.LocalBytes},
+		{"need_bytes", stats.NeedBytes},
+		{"global_files", stats.GlobalFiles},
+		{"need_total_items", stats.NeedTotalItems},
+	})
+	want := "syncthing_folder,folder_id=abcd-1234 global_bytes=6442450944,insync_bytes=5368709120,local_bytes=8796093022208,need_bytes=4294967296,global_files=4294967297,need_total_items=2147483648\n"
+	if line.String() != want {
+		t.Errorf("got %q, want %q", line.String(), want)
+	}
+}
+
+func TestLargeConnectionCounters(t *testing.T) {
+	var connections Connections
+	err := decodeResponse(fixtureResponse(`{
+		"total": {"inBytesTotal": 10995116277760, "outBytesTotal": 4294967296},
+		"connections": {
+			"AAAAAAA-BBBBBBB-CCCCCCC-DDDDDDD-EEEEEEE-FFFFFFF-GGGGGGG-HHHHHHH": {"connected": true, "inBytesTotal": 4294967297, "outBytesTotal": 9223372036854775807}
+		}
+	}`), &connections)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connection := connections.Connections["AAAAAAA-BBBBBBB-CCCCCCC-DDDDDDD-EEEEEEE-FFFFFFF-GGGGGGG-HHHHHHH"]
+	var line bytes.Buffer
+	appendLine(&line, "syncthing_connection_totals", nil, []field{
+		{"in_bytes", connections.Total.InBytesTotal},
+		{"out_bytes", connections.Total.OutBytesTotal},
+	})
+	appendLine(&line, "syncthing_connection", nil, []field{
+		{"in_bytes", connection.InBytesTotal},
+		{"out_bytes", connection.OutBytesTotal},
+	})
+	want := "syncthing_connection_totals in_bytes=10995116277760,out_bytes=4294967296\n" +
+		"syncthing_connection in_bytes=4294967297,out_bytes=9223372036854775807\n"
+	if line.String() != want {
+		t.Errorf("got %q, want %q", line.String(), want)
+	}
+}
+
+func TestResponseFieldDrift(t *testing.T) {
+	var raw interface{}
+	err := json.Unmarshal([]byte(`{
+		"total": {"inBytesTotal": 1, "at": "2020-01-01T00:00:00Z"},
+		"connections": {
+			"BBBBBBB": {"connected": true, "newField": 1},
+			"AAAAAAA": {"connected": false, "inBytesTotal": 2, "outBytesTotal": 3, "tilde": "~"}
+		}
+	}`), &raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type item struct {
+		Connected     bool  `json:"connected"`
+		InBytesTotal  int64 `json:"inBytesTotal"`
+		OutBytesTotal int64 `json:"outBytesTotal"`
+	}
+	type response struct {
+		Total       item            `json:"total"`
+		Connections map[string]item `json:"connections"`
+	}
+	responseType := reflect.TypeOf(response{})
+
+	missing := missingFields(responseType, raw, "")
+	wantMissing := []string{"total.connected", "total.outBytesTotal"}
+	if !reflect.DeepEqual(missing, wantMissing) {
+		t.Errorf("missing fields %v, want %v", missing, wantMissing)
+	}
+	// Maps are checked through the element with the smallest key.
+	unknown := unknownFields(responseType, raw, "")
+	wantUnknown := []string{"connections.AAAAAAA.tilde", "total.at"}
+	if !reflect.DeepEqual(unknown, wantUnknown) {
+		t.Errorf("unknown fields %v, want %v", unknown, wantUnknown)
+	}
+}
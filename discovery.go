@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var discoverSRVFlag = flag.String("discover-srv", "", "Discover Syncthing instances from DNS SRV records with this name, for example _syncthing._tcp.example.com")
+var discoverConsulFlag = flag.String("discover-consul", "", "Discover Syncthing instances registered in Consul with this service name")
+var consulAddressFlag = flag.String("consul-address", "http://127.0.0.1:8500", "Consul HTTP API URL")
+var discoverSchemeFlag = flag.String("discover-scheme", "http", "URL scheme used for discovered Syncthing instances")
+
+type ConsulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+func newDiscoveredInstance(host string, port int, apiKey string) *instance {
+	hostPort := net.JoinHostPort(host, strconv.Itoa(port))
+	return &instance{
+		servers: []string{fmt.Sprintf("%s://%s", *discoverSchemeFlag, hostPort)},
+		apiKey:  apiKey,
+		tags:    []tag{{"instance", hostPort}},
+	}
+}
+
+func discoverSRV(name string, apiKey string) ([]*instance, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("SRV lookup for %s failed: %s", name, err)
+	}
+	var instances []*instance
+	for _, record := range records {
+		instances = append(instances, newDiscoveredInstance(strings.TrimSuffix(record.Target, "."), int(record.Port), apiKey))
+	}
+	return instances, nil
+}
+
+func discoverConsul(service string, apiKey string) ([]*instance, error) {
+	resp, err := httpClient.Get(fmt.Sprintf("%s/v1/health/service/%s?passing=true", strings.TrimSuffix(*consulAddressFlag, "/"), url.PathEscape(service)))
+	if err != nil {
+		return nil, fmt.Errorf("Consul request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		// Consul explains errors, such as missing ACL permissions, in a
+		// plain text body.
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+		return nil, fmt.Errorf("Consul request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var entries []ConsulServiceEntry
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Consul response body: %s", err)
+	}
+	var instances []*instance
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		instances = append(instances, newDiscoveredInstance(address, entry.Service.Port, apiKey))
+	}
+	return instances, nil
+}
+
+// normalizeServerURL accepts server URLs without a scheme and with a trailing
+// slash, and keeps any base path used by a reverse proxy.
+func normalizeServerURL(raw string) (string, error) {
+	raw = strings.TrimSpace(raw)
+	if !strings.Contains(raw, "://") {
+		raw = "http://" + raw
+	}
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid server URL %s: %s", raw, err)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("invalid server URL %s: no host", raw)
+	}
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	parsed.RawQuery = ""
+	parsed.Fragment = ""
+	return parsed.String(), nil
+}
+
+// discoverInstances returns the instances to collect from. Without any
+// discovery options this is the single instance given with -server, which is
+// not tagged to keep the output unchanged for the common case. Several URLs in
+// -server are failover candidates for that one instance. Discovery runs
+// on every invocation, so new nodes are picked up on the next collection.
+func discoverInstances(apiKey string) ([]*instance, error) {
+	if *discoverSRVFlag == "" && *discoverConsulFlag == "" && *discoverK8sSelectorFlag == "" {
+		var servers []string
+		for _, candidate := range strings.Split(*server, ",") {
+			normalized, err := normalizeServerURL(candidate)
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, normalized)
+		}
+		return []*instance{{servers: servers, apiKey: apiKey}}, nil
+	}
+	var instances []*instance
+	if *discoverSRVFlag != "" {
+		discovered, err := discoverSRV(*discoverSRVFlag, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, discovered...)
+	}
+	if *discoverConsulFlag != "" {
+		discovered, err := discoverConsul(*discoverConsulFlag, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, discovered...)
+	}
+	if *discoverK8sSelectorFlag != "" {
+		discovered, err := discoverKubernetes(*discoverK8sSelectorFlag, apiKey)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, discovered...)
+	}
+	return instances, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestNormalizeServerURL(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want string
+		err  bool
+	}{
+		{raw: "127.0.0.1:8384", want: "http://127.0.0.1:8384"},
+		{raw: " localhost:8384/ ", want: "http://localhost:8384"},
+		{raw: "https://sync.example.com", want: "https://sync.example.com"},
+		{raw: "https://sync.example.com/syncthing/", want: "https://sync.example.com/syncthing"},
+		{raw: "http://[::1]:8384/?debug=1#status", want: "http://[::1]:8384"},
+		{raw: "", err: true},
+		{raw: "http:///syncthing", err: true},
+		{raw: "http://host:port", err: true},
+	}
+	for _, test := range tests {
+		got, err := normalizeServerURL(test.raw)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: got %q, want an error", test.raw, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", test.raw, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%q: got %q, want %q", test.raw, got, test.want)
+		}
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		server string
+		path   string
+		want   string
+	}{
+		{"http://127.0.0.1:8384", "rest/system/status", "http://127.0.0.1:8384/rest/system/status"},
+		{"https://sync.example.com/syncthing", "/rest/system/status", "https://sync.example.com/syncthing/rest/system/status"},
+		{"https://sync.example.com/syncthing/", apiPath("rest/db/status", url.Values{"folder": {"a&b c"}}), "https://sync.example.com/syncthing/rest/db/status?folder=a%26b+c"},
+	}
+	for _, test := range tests {
+		if got := apiURL(test.server, test.path); got != test.want {
+			t.Errorf("%q, %q: got %q, want %q", test.server, test.path, got, test.want)
+		}
+	}
+}
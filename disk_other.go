@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package main
+
+import "fmt"
+
+func diskUsage(path string) (free uint64, total uint64, err error) {
+	return 0, 0, fmt.Errorf("disk usage is not supported on this platform")
+}
@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var useEventAPIFlag = flag.Bool("use-event-api", false, "With -state-file, read the events Syncthing generated since the previous run from rest/events and emit counters of them")
+var useDownloadProgressFlag = flag.Bool("use-download-progress", false, "With -use-event-api, add files and bytes being downloaded per folder from DownloadProgress events")
+
+// Event is an entry of rest/events. The contents of Data depend on Type.
+type Event struct {
+	ID       int             `json:"id"`
+	GlobalID int             `json:"globalID"`
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// eventAPIState is the position in rest/events. Syncthing numbers the events
+// of each event type filter separately and starts over when it restarts, so
+// the position only holds for the same filter and start time.
+type eventAPIState struct {
+	LastID    int       `json:"lastID"`
+	Mask      string    `json:"mask"`
+	StartTime time.Time `json:"startTime"`
+	// Syncthing only sends DownloadProgress when the downloads progress, so
+	// the latest one is kept for the runs that get none.
+	Downloads map[string]downloadProgress `json:"downloads,omitempty"`
+	// The revision of the configuration that was saved last.
+	ConfigHash  string    `json:"configHash,omitempty"`
+	ConfigSaved time.Time `json:"configSaved"`
+}
+
+// downloadProgress is the sum of the downloads of a folder.
+type downloadProgress struct {
+	Files      int   `json:"files"`
+	BytesTotal int64 `json:"bytesTotal"`
+	BytesDone  int64 `json:"bytesDone"`
+}
+
+type folderDevice struct {
+	folder string
+	device string
+}
+
+// eventCounts accumulates the events read on one run.
+type eventCounts struct {
+	events       int
+	missedEvents int
+	failures     int
+
+	configChanges int
+	configHash    string
+	configSaved   time.Time
+
+	// The latest completion of each folder on each remote device.
+	completions map[folderDevice]FolderCompletionEvent
+	// The latest progress of each folder that is still scanning.
+	scans map[string]FolderScanProgressEvent
+
+	folders map[string]*folderEvents
+	devices map[string]*deviceEvents
+
+	downloads     map[string]downloadProgress
+	downloadsSeen bool
+}
+
+// folderEvents counts the events of a folder.
+type folderEvents struct {
+	itemsFinished   int
+	itemsFailed     int
+	updates         int
+	deletes         int
+	metadataUpdates int
+	localChanges    int
+	remoteChanges   int
+}
+
+func (c *eventCounts) folder(folderID string) *folderEvents {
+	if c.folders == nil {
+		c.folders = make(map[string]*folderEvents)
+	}
+	folder, ok := c.folders[folderID]
+	if !ok {
+		folder = &folderEvents{}
+		c.folders[folderID] = folder
+	}
+	return folder
+}
+
+// deviceEvents counts the events of a remote device.
+type deviceEvents struct {
+	connects    int
+	disconnects int
+}
+
+func (c *eventCounts) device(deviceID string) *deviceEvents {
+	if c.devices == nil {
+		c.devices = make(map[string]*deviceEvents)
+	}
+	device, ok := c.devices[deviceID]
+	if !ok {
+		device = &deviceEvents{}
+		c.devices[deviceID] = device
+	}
+	return device
+}
+
+// FolderCompletionEvent is the data of a FolderCompletion event, which is
+// db/completion of a folder and device.
+type FolderCompletionEvent struct {
+	FolderCompletion
+	Device string `json:"device"`
+	Folder string `json:"folder"`
+}
+
+// ItemFinishedEvent is the data of an ItemFinished event, sent when a file
+// has been synced or failed to sync.
+type ItemFinishedEvent struct {
+	Folder string  `json:"folder"`
+	Item   string  `json:"item"`
+	Error  *string `json:"error"`
+	Type   string  `json:"type"`
+	Action string  `json:"action"`
+}
+
+// FolderScanProgressEvent is the data of a FolderScanProgress event, sent
+// periodically while a folder is scanned. Current and Total are in bytes.
+type FolderScanProgressEvent struct {
+	Folder  string  `json:"folder"`
+	Current int64   `json:"current"`
+	Total   int64   `json:"total"`
+	Rate    float64 `json:"rate"`
+}
+
+// StateChangedEvent is the data of a StateChanged event, sent when a folder
+// changes state.
+type StateChangedEvent struct {
+	Folder string `json:"folder"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+}
+
+// ChangeDetectedEvent is the part of the LocalChangeDetected and
+// RemoteChangeDetected event data that is counted. Older Syncthing versions
+// only have the folder ID in Folder.
+type ChangeDetectedEvent struct {
+	Folder   string `json:"folder"`
+	FolderID string `json:"folderID"`
+}
+
+func (e ChangeDetectedEvent) folderID() string {
+	if e.FolderID != "" {
+		return e.FolderID
+	}
+	return e.Folder
+}
+
+// DownloadProgressEvent is the data of a DownloadProgress event, the progress
+// of each file being downloaded by folder and file name.
+type DownloadProgressEvent map[string]map[string]struct {
+	BytesTotal int64 `json:"bytesTotal"`
+	BytesDone  int64 `json:"bytesDone"`
+}
+
+// DeviceConnectionEvent is the part of the DeviceConnected and
+// DeviceDisconnected event data that is counted.
+type DeviceConnectionEvent struct {
+	ID string `json:"id"`
+}
+
+// eventCollectors count the events of each type requested from rest/events.
+var eventCollectors = map[string]func(*eventCounts, Event) error{
+	"FolderCompletion": func(c *eventCounts, event Event) error {
+		var data FolderCompletionEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		if c.completions == nil {
+			c.completions = make(map[folderDevice]FolderCompletionEvent)
+		}
+		c.completions[folderDevice{data.Folder, data.Device}] = data
+		return nil
+	},
+	"ItemFinished": func(c *eventCounts, event Event) error {
+		var data ItemFinishedEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		folder := c.folder(data.Folder)
+		folder.itemsFinished++
+		if data.Error != nil && *data.Error != "" {
+			folder.itemsFailed++
+		}
+		switch data.Action {
+		case "update":
+			folder.updates++
+		case "delete":
+			folder.deletes++
+		case "metadata":
+			folder.metadataUpdates++
+		}
+		return nil
+	},
+	// The data of a Failure event is the description of an internal error
+	// that Syncthing reports to its usage reporting server.
+	"Failure": func(c *eventCounts, event Event) error {
+		c.failures++
+		return nil
+	},
+	// The data of a ConfigSaved event is the whole configuration, so its hash
+	// identifies the revision.
+	"ConfigSaved": func(c *eventCounts, event Event) error {
+		hash := fnv.New64a()
+		hash.Write(event.Data)
+		c.configChanges++
+		c.configHash = fmt.Sprintf("%016x", hash.Sum64())
+		c.configSaved = event.Time
+		return nil
+	},
+	"FolderScanProgress": func(c *eventCounts, event Event) error {
+		var data FolderScanProgressEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		if c.scans == nil {
+			c.scans = make(map[string]FolderScanProgressEvent)
+		}
+		c.scans[data.Folder] = data
+		return nil
+	},
+	"StateChanged": func(c *eventCounts, event Event) error {
+		var data StateChangedEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		// The scan finished after the latest progress.
+		if data.From == "scanning" {
+			delete(c.scans, data.Folder)
+		}
+		return nil
+	},
+	"LocalChangeDetected": func(c *eventCounts, event Event) error {
+		var data ChangeDetectedEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		c.folder(data.folderID()).localChanges++
+		return nil
+	},
+	"RemoteChangeDetected": func(c *eventCounts, event Event) error {
+		var data ChangeDetectedEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		c.folder(data.folderID()).remoteChanges++
+		return nil
+	},
+	// Each DownloadProgress has all the files being downloaded.
+	"DownloadProgress": func(c *eventCounts, event Event) error {
+		var data DownloadProgressEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		c.downloads = make(map[string]downloadProgress)
+		c.downloadsSeen = true
+		for folderID, files := range data {
+			var progress downloadProgress
+			for _, file := range files {
+				progress.Files++
+				progress.BytesTotal += file.BytesTotal
+				progress.BytesDone += file.BytesDone
+			}
+			c.downloads[folderID] = progress
+		}
+		return nil
+	},
+	"DeviceConnected": func(c *eventCounts, event Event) error {
+		var data DeviceConnectionEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		c.device(data.ID).connects++
+		return nil
+	},
+	"DeviceDisconnected": func(c *eventCounts, event Event) error {
+		var data DeviceConnectionEvent
+		err := json.Unmarshal(event.Data, &data)
+		if err != nil {
+			return err
+		}
+		c.device(data.ID).disconnects++
+		return nil
+	},
+}
+
+// eventMask is the event type filter sent to rest/events. An empty filter
+// gets the default event types.
+func eventMask() string {
+	var types []string
+	for eventType := range eventCollectors {
+		if eventType == "DownloadProgress" && !*useDownloadProgressFlag {
+			continue
+		}
+		types = append(types, eventType)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ",")
+}
+
+func (c *eventCounts) add(event Event) error {
+	c.events++
+	collect, ok := eventCollectors[event.Type]
+	if !ok {
+		return nil
+	}
+	return collect(c, event)
+}
+
+func (c *eventCounts) emit(inst *instance) {
+	fields := []field{
+		{"events", c.events},
+		{"missed_events", c.missedEvents},
+		{"failures", c.failures},
+		{"config_changes", c.configChanges},
+	}
+	if c.configHash != "" {
+		fields = append(fields,
+			field{"config_hash", c.configHash},
+			field{"config_saved_seconds_ago", time.Since(c.configSaved).Seconds()},
+		)
+	}
+	inst.emit("syncthing_event_api", nil, fields)
+	folderLabels := make(map[string]string)
+	var deviceNames map[string]string
+	config, err := inst.config()
+	if err == nil {
+		for _, folder := range config.Folders {
+			folderLabels[folder.ID] = folder.Label
+			// Folders without events get zeros, rather than gaps.
+			c.folder(folder.ID)
+		}
+		myID, _ := localDeviceID(inst)
+		for _, device := range config.Devices {
+			if device.DeviceID != myID {
+				c.device(device.DeviceID)
+			}
+		}
+		deviceNames = uniqueDeviceNames(config.Devices)
+	}
+
+	for folderID, folder := range c.folders {
+		folderTags := []tag{{"folder_id", folderID}, {"folder_label", folderLabels[folderID]}}
+		inst.emit("syncthing_folder_items", folderTags, []field{
+			{"items_finished", folder.itemsFinished},
+			{"items_failed", folder.itemsFailed},
+			{"updates", folder.updates},
+			{"deletes", folder.deletes},
+			{"metadata_updates", folder.metadataUpdates},
+		})
+		inst.emit("syncthing_folder_changes", folderTags, []field{
+			{"local_changes", folder.localChanges},
+			{"remote_changes", folder.remoteChanges},
+		})
+	}
+
+	if *useDownloadProgressFlag {
+		folderIDs := make(map[string]bool)
+		for folderID := range folderLabels {
+			folderIDs[folderID] = true
+		}
+		for folderID := range c.downloads {
+			folderIDs[folderID] = true
+		}
+		for folderID := range folderIDs {
+			// Folders without downloads are not in the map and get zeros.
+			progress := c.downloads[folderID]
+			inst.emit("syncthing_folder_downloads", []tag{{"folder_id", folderID}, {"folder_label", folderLabels[folderID]}}, []field{
+				{"files", progress.Files},
+				{"total_bytes", progress.BytesTotal},
+				{"done_bytes", progress.BytesDone},
+				{"remaining_bytes", progress.BytesTotal - progress.BytesDone},
+			})
+		}
+	}
+
+	for deviceID, device := range c.devices {
+		inst.emit("syncthing_device_connections", []tag{{"device_id", deviceID}, {"device_name", deviceNames[deviceID]}}, []field{
+			{"connects", device.connects},
+			{"disconnects", device.disconnects},
+		})
+	}
+
+	for folderID, scan := range c.scans {
+		fields := []field{
+			{"current_bytes", scan.Current},
+			{"total_bytes", scan.Total},
+			{"rate", scan.Rate},
+		}
+		if scan.Total > 0 {
+			fields = append(fields, field{"completion_pct", 100 * float64(scan.Current) / float64(scan.Total)})
+		}
+		inst.emit("syncthing_folder_scan_progress", []tag{{"folder_id", folderID}, {"folder_label", folderLabels[folderID]}}, fields)
+	}
+
+	// Completion is written like db/completion does, so that the events
+	// can replace -use-completion.
+	for key, completion := range c.completions {
+		inst.emit("syncthing_folder_completion", []tag{{"folder_id", key.folder}, {"folder_label", folderLabels[key.folder]}, {"device_id", key.device}}, []field{
+			{"completion", completion.Completion},
+			{"global_bytes", completion.GlobalBytes},
+			{"global_items", completion.GlobalItems},
+			{"need_bytes", completion.NeedBytes},
+			{"need_items", completion.NeedItems},
+			{"need_deletes", completion.NeedDeletes},
+			{"remote_state", completion.RemoteState},
+		})
+	}
+}
+
+// resumeEvents tells whether the events can be read from the position stored
+// on the previous run. When the start time of Syncthing is not known, it is
+// assumed not to have restarted.
+func resumeEvents(previous *eventAPIState, mask string, startTime time.Time) bool {
+	if previous == nil || previous.Mask != mask {
+		return false
+	}
+	return startTime.IsZero() || previous.StartTime.Equal(startTime)
+}
+
+// readEvents counts the events of a rest/events response and returns the ID
+// of the latest one. Unless known, the events are only skipped to find the
+// latest ID.
+func readEvents(body io.Reader, since int, known bool) (eventCounts, int, error) {
+	var counts eventCounts
+	lastID := since
+	// The events are decoded one at a time, so that a busy instance with
+	// thousands of events since the previous run does not need them all in
+	// memory at once.
+	decoder := json.NewDecoder(body)
+	token, err := decoder.Token()
+	if err != nil {
+		return counts, lastID, fmt.Errorf("invalid response body: %s", err)
+	}
+	if delim, ok := token.(json.Delim); token != nil && (!ok || delim != '[') {
+		return counts, lastID, fmt.Errorf("invalid response body: expected an array of events")
+	}
+	for token != nil && decoder.More() {
+		var event Event
+		err = decoder.Decode(&event)
+		if err != nil {
+			return counts, lastID, fmt.Errorf("invalid response body: %s", err)
+		}
+		if !known {
+			lastID = event.ID
+			continue
+		}
+		if counts.events == 0 && event.ID > since+1 {
+			// Syncthing keeps a limited number of events, so some were
+			// dropped before they could be read.
+			counts.missedEvents = event.ID - since - 1
+		}
+		err = counts.add(event)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Invalid %s event %d: %s\n", event.Type, event.ID, err)))
+		}
+		lastID = event.ID
+	}
+	return counts, lastID, nil
+}
+
+// handleEventAPI reads the events since the previous run. On the first run,
+// and after Syncthing restarted, only the position of the latest event is
+// stored, so that the events already in the Syncthing buffer are not
+// counted as new.
+func handleEventAPI(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	mask := eventMask()
+	var startTime time.Time
+	status, err := inst.systemStatus()
+	if err == nil {
+		startTime = status.StartTime
+	}
+	var since int
+	var known bool
+	var downloads map[string]downloadProgress
+	var configHash string
+	var configSaved time.Time
+	inst.updateState(func(instState *instanceState) {
+		previous := instState.EventAPI
+		if !resumeEvents(previous, mask, startTime) {
+			return
+		}
+		if startTime.IsZero() {
+			startTime = previous.StartTime
+		}
+		since = previous.LastID
+		known = true
+		downloads = previous.Downloads
+		configHash = previous.ConfigHash
+		configSaved = previous.ConfigSaved
+	})
+
+	query := url.Values{"timeout": {"0"}}
+	if mask != "" {
+		query.Set("events", mask)
+	}
+	if known {
+		query.Set("since", strconv.Itoa(since))
+	} else {
+		query.Set("limit", "1")
+	}
+	resp, err := makeRequest(inst, apiPath("rest/events", query))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	counts, lastID, err := readEvents(resp.Body, since, known)
+	if err != nil {
+		return err
+	}
+	if !counts.downloadsSeen {
+		counts.downloads = downloads
+	}
+	if counts.configHash == "" {
+		counts.configHash = configHash
+		counts.configSaved = configSaved
+	}
+	inst.updateState(func(instState *instanceState) {
+		instState.EventAPI = &eventAPIState{
+			LastID:      lastID,
+			Mask:        mask,
+			StartTime:   startTime,
+			Downloads:   counts.downloads,
+			ConfigHash:  counts.configHash,
+			ConfigSaved: counts.configSaved,
+		}
+	})
+	counts.emit(inst)
+	return nil
+}
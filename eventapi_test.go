@@ -0,0 +1,154 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResumeEvents(t *testing.T) {
+	started := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	previous := &eventAPIState{LastID: 42, Mask: "ItemFinished", StartTime: started}
+	tests := []struct {
+		name      string
+		previous  *eventAPIState
+		mask      string
+		startTime time.Time
+		want      bool
+	}{
+		{"first run", nil, "ItemFinished", started, false},
+		{"same instance", previous, "ItemFinished", started, true},
+		{"restarted", previous, "ItemFinished", started.Add(time.Hour), false},
+		{"other event types", previous, "ItemFinished,StateChanged", started, false},
+		{"unknown start time", previous, "ItemFinished", time.Time{}, true},
+	}
+	for _, test := range tests {
+		if got := resumeEvents(test.previous, test.mask, test.startTime); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		since      int
+		known      bool
+		wantLastID int
+		wantEvents int
+		wantMissed int
+		err        bool
+	}{
+		{
+			name:       "first run only finds the position",
+			body:       `[{"id": 17, "type": "Failure", "data": "error"}]`,
+			wantLastID: 17,
+		},
+		{
+			name:       "no events",
+			body:       `[]`,
+			since:      17,
+			known:      true,
+			wantLastID: 17,
+		},
+		{
+			name:       "null",
+			body:       `null`,
+			since:      17,
+			known:      true,
+			wantLastID: 17,
+		},
+		{
+			name:       "events since",
+			body:       `[{"id": 18, "type": "Failure", "data": "error"}, {"id": 19, "type": "Unknown", "data": {}}]`,
+			since:      17,
+			known:      true,
+			wantLastID: 19,
+			wantEvents: 2,
+		},
+		{
+			name:       "dropped events",
+			body:       `[{"id": 25, "type": "Failure", "data": "error"}]`,
+			since:      17,
+			known:      true,
+			wantLastID: 25,
+			wantEvents: 1,
+			wantMissed: 7,
+		},
+		{
+			name:  "not an array",
+			body:  `{"id": 18}`,
+			since: 17,
+			known: true,
+			err:   true,
+		},
+		{
+			name:  "truncated",
+			body:  `[{"id": 18, "type": "Failure", "data": "err`,
+			since: 17,
+			known: true,
+			err:   true,
+		},
+	}
+	for _, test := range tests {
+		counts, lastID, err := readEvents(strings.NewReader(test.body), test.since, test.known)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: no error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if lastID != test.wantLastID || counts.events != test.wantEvents || counts.missedEvents != test.wantMissed {
+			t.Errorf("%s: got last ID %d, %d events, %d missed, want %d, %d, %d", test.name, lastID, counts.events, counts.missedEvents, test.wantLastID, test.wantEvents, test.wantMissed)
+		}
+	}
+}
+
+func TestEventCounts(t *testing.T) {
+	body := `[
+		{"id": 1, "type": "ItemFinished", "data": {"folder": "abcd-1234", "item": "a", "error": null, "action": "update"}},
+		{"id": 2, "type": "ItemFinished", "data": {"folder": "abcd-1234", "item": "b", "error": "permission denied", "action": "update"}},
+		{"id": 3, "type": "ItemFinished", "data": {"folder": "abcd-1234", "item": "c", "error": "", "action": "delete"}},
+		{"id": 4, "type": "LocalChangeDetected", "data": {"folder": "abcd-1234"}},
+		{"id": 5, "type": "RemoteChangeDetected", "data": {"folder": "Documents", "folderID": "abcd-1234"}},
+		{"id": 6, "type": "DeviceConnected", "data": {"id": "ABCDEFG-1234567"}},
+		{"id": 7, "type": "DeviceDisconnected", "data": {"id": "ABCDEFG-1234567"}},
+		{"id": 8, "type": "DeviceConnected", "data": {"id": "ABCDEFG-1234567"}},
+		{"id": 9, "type": "FolderScanProgress", "data": {"folder": "abcd-1234", "current": 10, "total": 100, "rate": 5}},
+		{"id": 10, "type": "FolderScanProgress", "data": {"folder": "efgh-5678", "current": 20, "total": 100, "rate": 5}},
+		{"id": 11, "type": "StateChanged", "data": {"folder": "abcd-1234", "from": "scanning", "to": "idle"}},
+		{"id": 12, "type": "DownloadProgress", "data": {"abcd-1234": {"a": {"bytesTotal": 100, "bytesDone": 10}}}},
+		{"id": 13, "type": "DownloadProgress", "data": {"abcd-1234": {"a": {"bytesTotal": 100, "bytesDone": 60}, "b": {"bytesTotal": 50, "bytesDone": 0}}}},
+		{"id": 14, "type": "ConfigSaved", "data": {"version": 37}},
+		{"id": 15, "type": "ItemFinished", "data": "not an object"}
+	]`
+	counts, lastID, err := readEvents(strings.NewReader(body), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastID != 15 || counts.events != 15 {
+		t.Errorf("got last ID %d and %d events, want 15 and 15", lastID, counts.events)
+	}
+	folder := counts.folders["abcd-1234"]
+	want := folderEvents{itemsFinished: 3, itemsFailed: 1, updates: 2, deletes: 1, localChanges: 1, remoteChanges: 1}
+	if folder == nil || *folder != want {
+		t.Errorf("got folder events %+v, want %+v", folder, want)
+	}
+	if device := counts.devices["ABCDEFG-1234567"]; device == nil || device.connects != 2 || device.disconnects != 1 {
+		t.Errorf("got device events %+v, want 2 connects and 1 disconnect", device)
+	}
+	if _, ok := counts.scans["abcd-1234"]; ok || len(counts.scans) != 1 {
+		t.Errorf("got scans %+v, want only efgh-5678", counts.scans)
+	}
+	if progress := counts.downloads["abcd-1234"]; progress != (downloadProgress{Files: 2, BytesTotal: 150, BytesDone: 60}) {
+		t.Errorf("got downloads %+v, want the latest DownloadProgress", progress)
+	}
+	if counts.configChanges != 1 || counts.configHash == "" {
+		t.Errorf("got %d config changes with hash %q, want 1 with a hash", counts.configChanges, counts.configHash)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+var useEventsFlag = flag.Bool("use-events", false, "With -state-file, emit syncthing_events for devices that disconnected, folders that ran into errors, configuration changes and Syncthing restarts since the previous run")
+
+// eventState is what the previous run observed, compared to the current run
+// to produce events. Maps are nil when the collector did not get the data.
+type eventState struct {
+	Uptime       *int            `json:"uptime,omitempty"`
+	Connected    map[string]bool `json:"connected,omitempty"`
+	FolderErrors map[string]bool `json:"folderErrors,omitempty"`
+	ConfigHash   uint64          `json:"configHash,omitempty"`
+}
+
+// observations collects the eventState of the current run from the
+// collectors.
+type observations struct {
+	sync.Mutex
+	current eventState
+}
+
+func (inst *instance) observeUptime(uptime int) {
+	if !*useEventsFlag {
+		return
+	}
+	inst.observed.Lock()
+	defer inst.observed.Unlock()
+	inst.observed.current.Uptime = &uptime
+}
+
+func (inst *instance) observeConnections(connections map[string]ConnectionStatItem) {
+	if !*useEventsFlag {
+		return
+	}
+	connected := make(map[string]bool)
+	for deviceID, connection := range connections {
+		connected[deviceID] = connection.Connected
+	}
+	inst.observed.Lock()
+	defer inst.observed.Unlock()
+	inst.observed.current.Connected = connected
+}
+
+// observeFolder records whether a folder is in error, that is, whether it
+// stopped altogether or fails to pull some files.
+func (inst *instance) observeFolder(folderID string, stats FolderStats) {
+	if !*useEventsFlag {
+		return
+	}
+	inst.observed.Lock()
+	defer inst.observed.Unlock()
+	if inst.observed.current.FolderErrors == nil {
+		inst.observed.current.FolderErrors = make(map[string]bool)
+	}
+	inst.observed.current.FolderErrors[folderID] = stats.State == "error" || stats.PullErrors > 0
+}
+
+// configHash covers the parts of the configuration the collector knows about:
+// folders, devices and the options in Options.
+func configHash(config *Config) uint64 {
+	contents, err := json.Marshal(config)
+	if err != nil {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write(contents)
+	return hash.Sum64()
+}
+
+// writeEvent writes an event directly, bypassing summary mode and
+// -only-changed, as every event is a separate occurrence.
+func (inst *instance) writeEvent(event string, tags []tag, text string) {
+	inst.write("syncthing_events", append([]tag{{"event", event}}, tags...), []field{{"text", text}}, false)
+}
+
+// emitEvents compares the observations of this run to the previous run,
+// emits the differences as events and saves the observations for the next
+// run. Data not observed on this run keeps its previous value.
+func (inst *instance) emitEvents() {
+	inst.observed.Lock()
+	current := inst.observed.current
+	inst.observed.Unlock()
+	deviceNames := make(map[string]string)
+	folderLabels := make(map[string]string)
+	config, err := inst.config()
+	if err == nil {
+		current.ConfigHash = configHash(config)
+		deviceNames = uniqueDeviceNames(config.Devices)
+		for _, folder := range config.Folders {
+			folderLabels[folder.ID] = folder.Label
+		}
+	}
+	var previous eventState
+	inst.updateState(func(instState *instanceState) {
+		if instState.Events == nil {
+			instState.Events = &eventState{}
+		}
+		previous = *instState.Events
+		if current.Uptime != nil {
+			instState.Events.Uptime = current.Uptime
+		}
+		if current.Connected != nil {
+			instState.Events.Connected = current.Connected
+		}
+		if current.FolderErrors != nil {
+			instState.Events.FolderErrors = current.FolderErrors
+		}
+		if current.ConfigHash != 0 {
+			instState.Events.ConfigHash = current.ConfigHash
+		}
+	})
+
+	if previous.Uptime != nil && current.Uptime != nil && *current.Uptime < *previous.Uptime {
+		inst.writeEvent("restarted", nil, "Syncthing restarted")
+	}
+	if previous.ConfigHash != 0 && current.ConfigHash != 0 && current.ConfigHash != previous.ConfigHash {
+		inst.writeEvent("config_changed", nil, "Syncthing configuration changed")
+	}
+	for _, deviceID := range sortedKeys(current.Connected) {
+		if previous.Connected[deviceID] && !current.Connected[deviceID] {
+			inst.writeEvent("device_disconnected",
+				[]tag{{"device_id", deviceID}, {"device_name", deviceNames[deviceID]}},
+				fmt.Sprintf("Device %s disconnected", deviceNames[deviceID]))
+		}
+	}
+	for _, folderID := range sortedKeys(current.FolderErrors) {
+		wasInError, ok := previous.FolderErrors[folderID]
+		if ok && !wasInError && current.FolderErrors[folderID] {
+			label := folderLabels[folderID]
+			if label == "" {
+				label = folderID
+			}
+			inst.writeEvent("folder_error",
+				[]tag{{"folder_id", folderID}, {"folder_label", folderLabels[folderID]}},
+				fmt.Sprintf("Folder %s has errors", label))
+		}
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
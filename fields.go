@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// fieldFilter maps measurement to the fields emitted for it. Measurements
+// without an entry are emitted with all fields.
+type fieldFilter map[string]map[string]bool
+
+func (f fieldFilter) String() string {
+	var filters []string
+	for measurement, fields := range f {
+		var names []string
+		for name := range fields {
+			names = append(names, name)
+		}
+		filters = append(filters, measurement+":"+strings.Join(names, ","))
+	}
+	return strings.Join(filters, " ")
+}
+
+// Set adds a filter in "measurement:field,field" format. The syncthing_
+// prefix of the measurement can be left out.
+func (f fieldFilter) Set(value string) error {
+	i := strings.Index(value, ":")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("fields must be in \"measurement:field,field\" format")
+	}
+	measurement := value[:i]
+	if !strings.HasPrefix(measurement, "syncthing_") {
+		measurement = "syncthing_" + measurement
+	}
+	if f[measurement] == nil {
+		f[measurement] = make(map[string]bool)
+	}
+	for _, name := range strings.Split(value[i+1:], ",") {
+		f[measurement][strings.TrimSpace(name)] = true
+	}
+	return nil
+}
+
+var fieldsFlag = make(fieldFilter)
+
+func init() {
+	flag.Var(fieldsFlag, "fields", "Emit only these fields of a measurement, in \"measurement:field,field\" format, for example folder:need_bytes,pull_errors. Can be repeated.")
+}
+
+// filterFields applies -fields. collection_ok is always kept, so failures
+// stay visible.
+func filterFields(measurement string, fields []field) []field {
+	allowed, ok := fieldsFlag[measurement]
+	if !ok {
+		return fields
+	}
+	var filtered []field
+	for _, f := range fields {
+		if allowed[f.key] || f.key == "collection_ok" {
+			filtered = append(filtered, f)
+		}
+	}
+	return filtered
+}
+
+var omitZeroFieldsFlag = flag.Bool("omit-zero-fields", false, "Leave out fields whose value is zero")
+var keepZeroFieldsFlag = flag.String("keep-zero-fields", "", "Comma-separated list of fields emitted even when zero with -omit-zero-fields")
+
+// alwaysKeptFields are never omitted, as zero is what they are about.
+var alwaysKeptFields = map[string]bool{
+	"up":            true,
+	"collection_ok": true,
+}
+
+var keptZeroFields = make(map[string]bool)
+var keptZeroFieldsOnce sync.Once
+
+func isZero(value interface{}) bool {
+	switch v := value.(type) {
+	case int:
+		return v == 0
+	case int64:
+		return v == 0
+	case uint64:
+		return v == 0
+	case float64:
+		return v == 0
+	}
+	return false
+}
+
+// omitZeroFields applies -omit-zero-fields.
+func omitZeroFields(fields []field) []field {
+	if !*omitZeroFieldsFlag {
+		return fields
+	}
+	keptZeroFieldsOnce.Do(func() {
+		for _, name := range strings.Split(*keepZeroFieldsFlag, ",") {
+			keptZeroFields[strings.TrimSpace(name)] = true
+		}
+	})
+	var kept []field
+	for _, f := range fields {
+		if !isZero(f.value) || alwaysKeptFields[f.key] || keptZeroFields[f.key] {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+var tagsAsFieldsFlag = flag.String("tags-as-fields", "", "Comma-separated list of tags emitted as string fields instead, for example device_name,crypto")
+var fieldsAsTagsFlag = flag.String("fields-as-tags", "", "Comma-separated list of string fields emitted as tags instead, for example address")
+
+var tagsAsFields = make(map[string]bool)
+var fieldsAsTags = make(map[string]bool)
+var placementOnce sync.Once
+
+// placeTagsAndFields applies -tags-as-fields and -fields-as-tags.
+func placeTagsAndFields(tags []tag, fields []field) ([]tag, []field) {
+	placementOnce.Do(func() {
+		for _, name := range strings.Split(*tagsAsFieldsFlag, ",") {
+			tagsAsFields[strings.TrimSpace(name)] = true
+		}
+		for _, name := range strings.Split(*fieldsAsTagsFlag, ",") {
+			fieldsAsTags[strings.TrimSpace(name)] = true
+		}
+	})
+	var placedTags []tag
+	var placedFields []field
+	for _, t := range tags {
+		if tagsAsFields[t.key] {
+			if t.value != "" {
+				placedFields = append(placedFields, field{t.key, t.value})
+			}
+			continue
+		}
+		placedTags = append(placedTags, t)
+	}
+	for _, f := range fields {
+		if value, ok := f.value.(string); ok && fieldsAsTags[f.key] {
+			placedTags = append(placedTags, tag{f.key, value})
+			continue
+		}
+		placedFields = append(placedFields, f)
+	}
+	return placedTags, placedFields
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+var discoverK8sSelectorFlag = flag.String("discover-k8s-selector", "", "Discover Syncthing pods in Kubernetes matching this label selector, for example app=syncthing")
+var k8sNamespaceFlag = flag.String("k8s-namespace", "", "Kubernetes namespace to discover pods in. Defaults to the namespace this pod runs in.")
+var k8sPortFlag = flag.Int("k8s-port", 8384, "Syncthing GUI/API port of discovered pods")
+
+// Pods can reference a secret holding their API key with this annotation.
+// The value is either "secret-name" or "secret-name/key"; the key defaults to
+// "apikey". Pods without the annotation use the key given with -apikey.
+const k8sAPIKeyAnnotation = "syncthing-telegraf-input/apikey-secret"
+
+const k8sServiceAccountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+type KubernetesPodList struct {
+	Items []struct {
+		Metadata struct {
+			Name        string            `json:"name"`
+			Namespace   string            `json:"namespace"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"metadata"`
+		Status struct {
+			Phase string `json:"phase"`
+			PodIP string `json:"podIP"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type KubernetesSecret struct {
+	Data map[string][]byte `json:"data"`
+}
+
+type kubernetesClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+func newKubernetesClient() (*kubernetesClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside Kubernetes: KUBERNETES_SERVICE_HOST/PORT not set")
+	}
+	token, err := ioutil.ReadFile(k8sServiceAccountPath + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account token: %s", err)
+	}
+	ca, err := ioutil.ReadFile(k8sServiceAccountPath + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("unable to read service account CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("invalid service account CA certificate")
+	}
+	return &kubernetesClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubernetesClient) get(path string, target interface{}) error {
+	req, err := http.NewRequest("GET", k.server+path, nil)
+	if err != nil {
+		return fmt.Errorf("unable to create HTTP request: %s", err)
+	}
+	req.Header.Add("Authorization", "Bearer "+k.token)
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Kubernetes API request failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Kubernetes API request %s failed: %s", path, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(target)
+	if err != nil {
+		return fmt.Errorf("invalid Kubernetes API response body: %s", err)
+	}
+	return nil
+}
+
+func (k *kubernetesClient) secretValue(namespace string, reference string) (string, error) {
+	name, key := reference, "apikey"
+	if i := strings.Index(reference, "/"); i >= 0 {
+		name, key = reference[:i], reference[i+1:]
+	}
+	var secret KubernetesSecret
+	err := k.get(fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", url.PathEscape(namespace), url.PathEscape(name)), &secret)
+	if err != nil {
+		return "", err
+	}
+	value, ok := secret.Data[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s/%s has no key %s", namespace, name, key)
+	}
+	return strings.TrimSpace(string(value)), nil
+}
+
+func discoverKubernetes(selector string, apiKey string) ([]*instance, error) {
+	k, err := newKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+	namespace := *k8sNamespaceFlag
+	if namespace == "" {
+		ownNamespace, err := ioutil.ReadFile(k8sServiceAccountPath + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("unable to read own namespace, use -k8s-namespace: %s", err)
+		}
+		namespace = strings.TrimSpace(string(ownNamespace))
+	}
+	var pods KubernetesPodList
+	err = k.get(fmt.Sprintf("/api/v1/namespaces/%s/pods?labelSelector=%s", url.PathEscape(namespace), url.QueryEscape(selector)), &pods)
+	if err != nil {
+		return nil, err
+	}
+	var instances []*instance
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != "Running" || pod.Status.PodIP == "" {
+			continue
+		}
+		podAPIKey := apiKey
+		if reference, ok := pod.Metadata.Annotations[k8sAPIKeyAnnotation]; ok {
+			podAPIKey, err = k.secretValue(pod.Metadata.Namespace, reference)
+			if err != nil {
+				os.Stderr.Write([]byte(fmt.Sprintf("Skipping pod %s/%s: %s\n", pod.Metadata.Namespace, pod.Metadata.Name, err)))
+				continue
+			}
+		}
+		if podAPIKey == "" {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping pod %s/%s: no API key\n", pod.Metadata.Namespace, pod.Metadata.Name)))
+			continue
+		}
+		// The pod IP changes when the pod is restarted, so it is only used to
+		// connect. The series and the state file entry of the pod follow its
+		// name, which a StatefulSet keeps.
+		inst := newDiscoveredInstance(pod.Status.PodIP, *k8sPortFlag, podAPIKey)
+		inst.tags = []tag{
+			{"instance", pod.Metadata.Namespace + "/" + pod.Metadata.Name},
+			{"pod", pod.Metadata.Name},
+			{"namespace", pod.Metadata.Namespace},
+		}
+		instances = append(instances, inst)
+	}
+	return instances, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The collectors in this file look at the folder paths on the local
+// filesystem, so they only work when running on the Syncthing host (or with
+// the folders mounted at the same paths).
+
+const conflictMarker = ".sync-conflict-"
+
+// versionsDir holds the versions kept by the versioning, which are not
+// counted as conflicts.
+const versionsDir = ".stversions"
+
+// defaultMarkerName is used for folders without a custom marker name.
+const defaultMarkerName = ".stfolder"
+
+// folderPath expands the home directory prefix Syncthing allows in folder
+// paths.
+func folderPath(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") && !strings.HasPrefix(path, "~"+string(os.PathSeparator)) {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("unable to expand %s: %s", path, err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
+
+// versionsPath returns the directory holding the versions of a folder. Older
+// Syncthing versions configure it with the versionsPath parameter, newer ones
+// with fsPath. Relative paths are relative to the folder.
+func versionsPath(folder FolderConfig, root string) (string, error) {
+	path := folder.Versioning.FsPath
+	if path == "" {
+		path = folder.Versioning.Params["versionsPath"]
+	}
+	if path == "" {
+		return filepath.Join(root, versionsDir), nil
+	}
+	path, err := folderPath(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	return path, nil
+}
+
+func directorySize(root string) (files int, size int64, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			files++
+			size += info.Size()
+		}
+		return nil
+	})
+	return files, size, err
+}
+
+func countConflicts(root string) (count int, size int64, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// Unreadable subdirectories are skipped rather than failing
+			// the whole folder.
+			return nil
+		}
+		if info.IsDir() {
+			if info.Name() == versionsDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.Contains(info.Name(), conflictMarker) {
+			count++
+			size += info.Size()
+		}
+		return nil
+	})
+	return count, size, err
+}
+
+func handleConflicts(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+	for _, folder := range folderConfig {
+		root, err := folderPath(folder.Path)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping conflicts of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		count, size, err := countConflicts(root)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping conflicts of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		inst.emit("syncthing_folder_conflicts", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}}, []field{
+			{"conflicts", count},
+			{"conflict_bytes", size},
+		})
+	}
+	return nil
+}
+
+func handleDiskUsage(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+	for _, folder := range folderConfig {
+		root, err := folderPath(folder.Path)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping disk usage of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		free, total, err := diskUsage(root)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping disk usage of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		fields := []field{{"free_bytes", free}, {"total_bytes", total}}
+		// Paused folders have no status to compare against.
+		if !folder.Paused {
+			// The status is shared with the folder collector.
+			status, err := inst.folderStatus(folder.ID)
+			if err != nil {
+				os.Stderr.Write([]byte(fmt.Sprintf("Unable to read status for %s: %s\n", folder.ID, err)))
+			} else if status.NeedBytes > 0 {
+				fields = append(fields, field{"free_vs_need_ratio", float64(free) / float64(status.NeedBytes)})
+			}
+		}
+		inst.emit("syncthing_folder_disk", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}}, fields)
+	}
+	return nil
+}
+
+// handleMarkerCheck reports whether the folder marker exists. Syncthing stops
+// a folder without its marker, to avoid deleting everything when the disk
+// holding the folder is not mounted.
+func handleMarkerCheck(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+	for _, folder := range folderConfig {
+		root, err := folderPath(folder.Path)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping marker check of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		markerName := folder.MarkerName
+		if markerName == "" {
+			markerName = defaultMarkerName
+		}
+		markerPresent := 1
+		_, err = os.Stat(filepath.Join(root, markerName))
+		if os.IsNotExist(err) {
+			markerPresent = 0
+		} else if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping marker check of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		inst.emit("syncthing_folder_marker", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}}, []field{{"marker_present", markerPresent}})
+	}
+	return nil
+}
+
+func handleVersionsSize(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+	for _, folder := range folderConfig {
+		// External versioning keeps the versions wherever the command puts
+		// them.
+		if folder.Versioning.Type == "" || folder.Versioning.Type == "external" {
+			continue
+		}
+		root, err := folderPath(folder.Path)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping versions of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		path, err := versionsPath(folder, root)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping versions of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		files, size, err := directorySize(path)
+		if os.IsNotExist(err) {
+			// Nothing has been versioned yet.
+			files, size, err = 0, 0, nil
+		}
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping versions of folder %s: %s\n", folder.ID, err)))
+			continue
+		}
+		inst.emit("syncthing_folder_versions", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}, {"versioning", folder.Versioning.Type}}, []field{
+			{"files", files},
+			{"bytes", size},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+var alertSMTPServerFlag = flag.String("alert-smtp-server", "", "With -alert-rule, send alerts by email through this SMTP server, in host:port format")
+var alertSMTPUserFlag = flag.String("alert-smtp-user", "", "SMTP username. Without it, mail is sent without authentication.")
+var alertSMTPPasswordFlag = flag.String("alert-smtp-password", "", "SMTP password")
+var alertSMTPFromFlag = flag.String("alert-smtp-from", "", "Sender address of alert emails")
+var alertSMTPToFlag = flag.String("alert-smtp-to", "", "Comma-separated list of recipients of alert emails")
+var alertSMTPSubjectFlag = flag.String("alert-smtp-subject", "Syncthing alert {{.Rule}} {{.Status}}", "Go template of the subject of alert emails")
+var alertSMTPBodyFlag = flag.String("alert-smtp-body", "{{.Rule}} is {{.Status}}: {{.Condition}}, met since {{.Since.Format \"2006-01-02 15:04:05 MST\"}}.\n\n{{.Measurement}} {{.Field}}={{.Value}}\n{{range $key, $value := .Tags}}{{$key}}={{$value}}\n{{end}}", "Go template of the body of alert emails")
+
+var alertPagerDutyKeyFlag = flag.String("alert-pagerduty-key", "", "With -alert-rule, trigger and resolve PagerDuty incidents through the Events API v2 with this integration routing key")
+var alertPagerDutyURLFlag = flag.String("alert-pagerduty-url", "https://events.pagerduty.com/v2/enqueue", "PagerDuty Events API v2 URL")
+var alertOpsgenieKeyFlag = flag.String("alert-opsgenie-key", "", "With -alert-rule, create and close Opsgenie alerts with this API integration key")
+var alertOpsgenieURLFlag = flag.String("alert-opsgenie-url", "https://api.opsgenie.com", "Opsgenie API URL, https://api.eu.opsgenie.com for the EU instance")
+
+var alertNtfyFlag = flag.String("alert-ntfy", "", "With -alert-rule, publish alerts to this ntfy topic URL, for example https://ntfy.sh/my-syncthing")
+var alertNtfyTokenFlag = flag.String("alert-ntfy-token", "", "Access token for a protected ntfy topic")
+var alertGotifyFlag = flag.String("alert-gotify", "", "With -alert-rule, push alerts to this Gotify server URL")
+var alertGotifyTokenFlag = flag.String("alert-gotify-token", "", "Gotify application token")
+
+var alertSMTPSubject *template.Template
+var alertSMTPBody *template.Template
+
+// parseSMTPTemplates parses the email templates, so that errors in them are
+// reported on startup rather than when an alert fires.
+func parseSMTPTemplates() error {
+	var err error
+	alertSMTPSubject, err = template.New("subject").Parse(*alertSMTPSubjectFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -alert-smtp-subject: %s", err)
+	}
+	alertSMTPBody, err = template.New("body").Parse(*alertSMTPBodyFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -alert-smtp-body: %s", err)
+	}
+	return nil
+}
+
+func sendEmail(alert alertNotification) error {
+	var subject, body bytes.Buffer
+	err := alertSMTPSubject.Execute(&subject, alert)
+	if err != nil {
+		return err
+	}
+	err = alertSMTPBody.Execute(&body, alert)
+	if err != nil {
+		return err
+	}
+	var recipients []string
+	for _, recipient := range strings.Split(*alertSMTPToFlag, ",") {
+		recipients = append(recipients, strings.TrimSpace(recipient))
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", *alertSMTPFromFlag)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(recipients, ", "))
+	// Line breaks in the subject would start new headers.
+	fmt.Fprintf(&message, "Subject: %s\r\n", strings.Join(strings.Fields(subject.String()), " "))
+	fmt.Fprintf(&message, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.Replace(body.String(), "\n", "\r\n", -1))
+	var auth smtp.Auth
+	if *alertSMTPUserFlag != "" {
+		host, _, err := net.SplitHostPort(*alertSMTPServerFlag)
+		if err != nil {
+			return fmt.Errorf("invalid SMTP server %s: %s", *alertSMTPServerFlag, err)
+		}
+		auth = smtp.PlainAuth("", *alertSMTPUserFlag, *alertSMTPPasswordFlag, host)
+	}
+	return smtp.SendMail(*alertSMTPServerFlag, auth, *alertSMTPFromFlag, recipients, message.Bytes())
+}
+
+// sendPagerDuty triggers a PagerDuty incident, and resolves it through the
+// same deduplication key when the alert resolves.
+func sendPagerDuty(alert alertNotification) error {
+	event := map[string]interface{}{
+		"routing_key":  *alertPagerDutyKeyFlag,
+		"event_action": "trigger",
+		"dedup_key":    alert.dedupKey(),
+	}
+	if alert.Status == "resolved" {
+		event["event_action"] = "resolve"
+	} else {
+		event["payload"] = map[string]interface{}{
+			"summary":        alert.summary(),
+			"source":         alert.Instance,
+			"severity":       "error",
+			"component":      alert.Measurement,
+			"custom_details": alert,
+		}
+	}
+	return postJSON(*alertPagerDutyURLFlag, nil, event)
+}
+
+// sendOpsgenie creates an Opsgenie alert, and closes it through the same
+// alias when the alert resolves.
+func sendOpsgenie(alert alertNotification) error {
+	headers := map[string]string{"Authorization": "GenieKey " + *alertOpsgenieKeyFlag}
+	apiURL := strings.TrimSuffix(*alertOpsgenieURLFlag, "/") + "/v2/alerts"
+	if alert.Status == "resolved" {
+		closeURL := apiURL + "/" + url.PathEscape(alert.dedupKey()) + "/close?identifierType=alias"
+		return postJSON(closeURL, headers, map[string]string{"source": "syncthing_stats", "note": alert.summary()})
+	}
+	message := alert.summary()
+	// Opsgenie cuts the message at 130 characters.
+	if runes := []rune(message); len(runes) > 130 {
+		message = string(runes[:127]) + "..."
+	}
+	return postJSON(apiURL, headers, map[string]interface{}{
+		"message":     message,
+		"alias":       alert.dedupKey(),
+		"description": alert.summary(),
+		"details":     alert.Tags,
+		"source":      "syncthing_stats",
+		"tags":        []string{"syncthing", alert.Rule},
+	})
+}
+
+// alertTitle is the title of push notifications.
+func alertTitle(alert alertNotification) string {
+	return fmt.Sprintf("Syncthing alert %s %s", alert.Rule, alert.Status)
+}
+
+func sendNtfy(alert alertNotification) error {
+	headers := map[string]string{
+		"Title":    alertTitle(alert),
+		"Tags":     "warning",
+		"Priority": "high",
+	}
+	if alert.Status == "resolved" {
+		headers["Tags"] = "white_check_mark"
+		headers["Priority"] = "default"
+	}
+	if *alertNtfyTokenFlag != "" {
+		headers["Authorization"] = "Bearer " + *alertNtfyTokenFlag
+	}
+	return post(*alertNtfyFlag, "text/plain; charset=utf-8", headers, []byte(alert.summary()))
+}
+
+func sendGotify(alert alertNotification) error {
+	priority := 8
+	if alert.Status == "resolved" {
+		priority = 4
+	}
+	return postJSON(strings.TrimSuffix(*alertGotifyFlag, "/")+"/message", map[string]string{"X-Gotify-Key": *alertGotifyTokenFlag}, map[string]interface{}{
+		"title":    alertTitle(alert),
+		"message":  alert.summary(),
+		"priority": priority,
+	})
+}
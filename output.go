@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type tag struct {
+	key   string
+	value string
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+var measurementEscaper = strings.NewReplacer(",", "\\,", " ", "\\ ")
+var tagEscaper = strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ")
+var stringFieldEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
+
+var sortOutputFlag = flag.Bool("sort-output", false, "Sort the output lines and tags, so that the output of consecutive runs can be compared")
+
+var outputFormatFlag = flag.String("output-format", "influx", "Output format: influx for line protocol, or json for the telegraf json parser")
+
+var outputMutex sync.Mutex
+
+// bufferedLines holds the output until flushOutput when it is sorted. JSON
+// documents are always held, as they are written out as a single array.
+var bufferedLines []string
+
+// sanitize makes a string safe for line protocol, which has no way to escape
+// line breaks and requires valid UTF-8. Invalid bytes become the Unicode
+// replacement character and control characters become spaces.
+func sanitize(value string) string {
+	value = strings.ToValidUTF8(value, "\uFFFD")
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return ' '
+		}
+		return r
+	}, value)
+}
+
+// escapeBackslashes doubles the backslashes at the end of a name or in front
+// of a character escaped by the escapers above. Parsers read a backslash as
+// escaping the next character, so these would otherwise swallow a delimiter.
+// Other backslashes are written as they are.
+func escapeBackslashes(value string) string {
+	if !strings.Contains(value, "\\") {
+		return value
+	}
+	var escaped strings.Builder
+	for i := 0; i < len(value); {
+		if value[i] != '\\' {
+			escaped.WriteByte(value[i])
+			i++
+			continue
+		}
+		end := i
+		for end < len(value) && value[end] == '\\' {
+			end++
+		}
+		escaped.WriteString(value[i:end])
+		if end == len(value) || strings.IndexByte(", =", value[end]) >= 0 {
+			escaped.WriteString(value[i:end])
+		}
+		i = end
+	}
+	return escaped.String()
+}
+
+// appendValue appends a field value. Integers are written without the "i"
+// suffix to keep the output compatible with what earlier versions produced.
+func appendValue(line *bytes.Buffer, value interface{}) {
+	var scratch [32]byte
+	switch v := value.(type) {
+	case int:
+		line.Write(strconv.AppendInt(scratch[:0], int64(v), 10))
+	case int64:
+		line.Write(strconv.AppendInt(scratch[:0], v, 10))
+	case uint64:
+		line.Write(strconv.AppendUint(scratch[:0], v, 10))
+	case float64:
+		line.Write(strconv.AppendFloat(scratch[:0], v, 'f', 6, 64))
+	case bool:
+		line.Write(strconv.AppendBool(scratch[:0], v))
+	case string:
+		line.WriteByte('"')
+		stringFieldEscaper.WriteString(line, sanitize(v))
+		line.WriteByte('"')
+	default:
+		fmt.Fprintf(line, "%v", v)
+	}
+}
+
+// appendLine appends a single line in InfluxDB line protocol. Tags with an
+// empty value are omitted, as line protocol does not allow them.
+func appendLine(line *bytes.Buffer, measurement string, tags []tag, fields []field) {
+	measurementEscaper.WriteString(line, escapeBackslashes(sanitize(measurement)))
+	if *sortOutputFlag {
+		sorted := make([]tag, len(tags))
+		copy(sorted, tags)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+		tags = sorted
+	}
+	for _, t := range tags {
+		if t.value == "" {
+			continue
+		}
+		line.WriteByte(',')
+		tagEscaper.WriteString(line, escapeBackslashes(sanitize(t.key)))
+		line.WriteByte('=')
+		tagEscaper.WriteString(line, escapeBackslashes(sanitize(t.value)))
+	}
+	for i, f := range fields {
+		if i == 0 {
+			line.WriteByte(' ')
+		} else {
+			line.WriteByte(',')
+		}
+		tagEscaper.WriteString(line, escapeBackslashes(sanitize(f.key)))
+		line.WriteByte('=')
+		appendValue(line, f.value)
+	}
+	line.WriteByte('\n')
+}
+
+// appendDocument appends a flat JSON document for the telegraf json parser.
+// The measurement is in "name", and tags and fields share the top level.
+// JSON has no NaN or infinity, so such fields are left out.
+func appendDocument(line *bytes.Buffer, measurement string, tags []tag, fields []field) error {
+	document := map[string]interface{}{"name": measurement}
+	for _, t := range tags {
+		if t.value != "" {
+			document[t.key] = t.value
+		}
+	}
+	for _, f := range fields {
+		if v, ok := f.value.(float64); ok && (math.IsNaN(v) || math.IsInf(v, 0)) {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping field %s of %s: %v is not a JSON number\n", f.key, measurement, v)))
+			continue
+		}
+		document[f.key] = f.value
+	}
+	// json.Encoder escapes invalid UTF-8 and control characters, and writes
+	// map keys sorted.
+	return json.NewEncoder(line).Encode(document)
+}
+
+// Lines are assembled in pooled buffers and written to stdout through a
+// single buffered writer, which is flushed by flushOutput.
+var linePool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+var stdout = bufio.NewWriter(os.Stdout)
+
+// selectFields applies the options choosing the tags and fields of a series
+// and their units. Nothing is written when no fields are left.
+func selectFields(measurement string, tags []tag, fields []field) ([]tag, []field) {
+	if *tagsAsFieldsFlag != "" || *fieldsAsTagsFlag != "" {
+		tags, fields = placeTagsAndFields(tags, fields)
+	}
+	return tags, scaleByteFields(omitZeroFields(filterFields(measurement, fields)))
+}
+
+func writeMeasurement(measurement string, tags []tag, fields []field) {
+	tags, fields = selectFields(measurement, tags, fields)
+	if len(fields) == 0 {
+		return
+	}
+	writeLine(measurement, tags, fields)
+}
+
+// writeLine renames a series and writes it out.
+func writeLine(measurement string, tags []tag, fields []field) {
+	if len(renamesFlag) > 0 {
+		measurement, tags, fields = renameSeries(measurement, tags, fields)
+	}
+	line := linePool.Get().(*bytes.Buffer)
+	defer linePool.Put(line)
+	line.Reset()
+	if *outputFormatFlag == "json" {
+		err := appendDocument(line, measurement, tags, fields)
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Skipping %s: %s\n", measurement, err)))
+			return
+		}
+	} else {
+		appendLine(line, measurement, tags, fields)
+	}
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if *sortOutputFlag || *outputFormatFlag == "json" {
+		bufferedLines = append(bufferedLines, line.String())
+		return
+	}
+	stdout.Write(line.Bytes())
+}
+
+// flushOutput writes out the lines held back for sorting and flushes stdout.
+func flushOutput() {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	if *sortOutputFlag {
+		sort.Strings(bufferedLines)
+	}
+	if *outputFormatFlag == "json" {
+		stdout.WriteString("[\n")
+		for i, line := range bufferedLines {
+			if i > 0 {
+				stdout.WriteString(",\n")
+			}
+			stdout.WriteString(strings.TrimSuffix(line, "\n"))
+		}
+		stdout.WriteString("\n]\n")
+	} else {
+		for _, line := range bufferedLines {
+			stdout.WriteString(line)
+		}
+	}
+	bufferedLines = nil
+	stdout.Flush()
+}
@@ -0,0 +1,34 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzAppendLine(f *testing.F) {
+	f.Add("folder_label", "My Docs, stuff", "need_bytes", "text")
+	f.Add("device_name", "a\nb\x00c", "f=g", "\"quoted\" \\")
+	f.Add("path", `C:\data\`, `a\ b`, "\xff")
+	f.Fuzz(func(t *testing.T, tagKey string, tagValue string, fieldKey string, fieldValue string) {
+		// The collectors never emit empty keys.
+		if tagKey == "" || fieldKey == "" {
+			return
+		}
+		var line bytes.Buffer
+		appendLine(&line, "syncthing_fuzz", []tag{{tagKey, tagValue}}, []field{{fieldKey, fieldValue}, {"count", 1}})
+		tags, fields, err := parseLine(line.String())
+		if err != nil {
+			t.Fatalf("invalid line %q: %s", line.String(), err)
+		}
+		wantTags := 1
+		if tagValue == "" {
+			wantTags = 0
+		}
+		if len(tags) != wantTags || len(fields) != 2 {
+			t.Fatalf("got %d tags and %d fields from %q", len(tags), len(fields), line.String())
+		}
+	})
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"unicode"
+	"unicode/utf8"
+)
+
+// lineParser reads line protocol the way InfluxDB and Telegraf do, where a
+// backslash escapes the character after it.
+type lineParser struct {
+	line string
+	pos  int
+}
+
+func (p *lineParser) peek() byte {
+	if p.pos >= len(p.line) {
+		return 0
+	}
+	return p.line[p.pos]
+}
+
+func (p *lineParser) readName(delimiters string) string {
+	start := p.pos
+	for p.pos < len(p.line) && strings.IndexByte(delimiters, p.line[p.pos]) < 0 {
+		if p.line[p.pos] == '\\' && p.pos+1 < len(p.line) {
+			p.pos++
+		}
+		p.pos++
+	}
+	return p.line[start:p.pos]
+}
+
+func (p *lineParser) readString() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.line) && p.line[p.pos] != '"' {
+		if p.line[p.pos] == '\\' {
+			p.pos++
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.line) {
+		return "", fmt.Errorf("unterminated string at %d", start)
+	}
+	p.pos++
+	return p.line[start:p.pos], nil
+}
+
+func (p *lineParser) readPair(isField bool) (string, string, error) {
+	key := p.readName("=, ")
+	if key == "" || p.peek() != '=' {
+		return "", "", fmt.Errorf("invalid key at %d", p.pos)
+	}
+	p.pos++
+	var value string
+	if p.peek() == '"' && isField {
+		var err error
+		value, err = p.readString()
+		if err != nil {
+			return "", "", err
+		}
+	} else {
+		value = p.readName(", ")
+	}
+	if value == "" {
+		return "", "", fmt.Errorf("empty value for %s", key)
+	}
+	return key, value, nil
+}
+
+// parseLine checks that line is exactly one valid line and returns its tags
+// and fields as written.
+func parseLine(line string) (tags [][2]string, fields [][2]string, err error) {
+	if !strings.HasSuffix(line, "\n") || strings.Count(line, "\n") != 1 {
+		return nil, nil, fmt.Errorf("not a single line")
+	}
+	line = strings.TrimSuffix(line, "\n")
+	if !utf8.ValidString(line) {
+		return nil, nil, fmt.Errorf("invalid UTF-8")
+	}
+	for _, r := range line {
+		if unicode.IsControl(r) {
+			return nil, nil, fmt.Errorf("control character %q", r)
+		}
+	}
+	p := &lineParser{line: line}
+	if p.readName(", ") == "" {
+		return nil, nil, fmt.Errorf("empty measurement")
+	}
+	for p.peek() == ',' {
+		p.pos++
+		key, value, err := p.readPair(false)
+		if err != nil {
+			return nil, nil, err
+		}
+		tags = append(tags, [2]string{key, value})
+	}
+	if p.peek() != ' ' {
+		return nil, nil, fmt.Errorf("no fields")
+	}
+	for p.peek() == ' ' || p.peek() == ',' {
+		p.pos++
+		key, value, err := p.readPair(true)
+		if err != nil {
+			return nil, nil, err
+		}
+		fields = append(fields, [2]string{key, value})
+		if p.peek() == ' ' {
+			return nil, nil, fmt.Errorf("unexpected space at %d", p.pos)
+		}
+	}
+	if p.pos != len(line) {
+		return nil, nil, fmt.Errorf("trailing data at %d", p.pos)
+	}
+	return tags, fields, nil
+}
+
+func TestAppendLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		tags   []tag
+		fields []field
+		want   string
+	}{
+		{
+			name:   "delimiters in names and values",
+			tags:   []tag{{"folder_label", "My Docs, stuff"}, {"a=b", "c d"}},
+			fields: []field{{"need bytes", 1}, {"x,y", "z"}},
+			want:   "m,folder_label=My\\ Docs\\,\\ stuff,a\\=b=c\\ d need\\ bytes=1,x\\,y=\"z\"\n",
+		},
+		{
+			name:   "line breaks",
+			tags:   []tag{{"folder_label", "two\nlines\r\n"}},
+			fields: []field{{"text", "a\nb"}},
+			want:   "m,folder_label=two\\ lines\\ \\  text=\"a b\"\n",
+		},
+		{
+			name:   "NUL",
+			tags:   []tag{{"device_name", "a\x00b"}},
+			fields: []field{{"f\x00", 1}},
+			want:   "m,device_name=a\\ b f\\ =1\n",
+		},
+		{
+			name:   "invalid UTF-8",
+			tags:   []tag{{"folder_label", "bad\xffbyte"}},
+			fields: []field{{"value", "\xfe"}},
+			want:   "m,folder_label=bad\uFFFDbyte value=\"\uFFFD\"\n",
+		},
+		{
+			name:   "quotes and backslashes in strings",
+			fields: []field{{"text", `say "hi" \ bye\`}},
+			want:   "m text=\"say \\\"hi\\\" \\\\ bye\\\\\"\n",
+		},
+		{
+			name:   "backslashes in names",
+			tags:   []tag{{"path", `C:\data`}, {"end", `dir\`}, {"before", `a\,b`}},
+			fields: []field{{"value", 1}},
+			want:   "m,path=C:\\data,end=dir\\\\,before=a\\\\\\,b value=1\n",
+		},
+		{
+			name:   "empty tag values",
+			tags:   []tag{{"device_name", ""}, {"device_id", "x"}},
+			fields: []field{{"value", 1}},
+			want:   "m,device_id=x value=1\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var line bytes.Buffer
+			appendLine(&line, "m", test.tags, test.fields)
+			if line.String() != test.want {
+				t.Errorf("got %q, want %q", line.String(), test.want)
+			}
+			tags, fields, err := parseLine(line.String())
+			if err != nil {
+				t.Fatalf("invalid line %q: %s", line.String(), err)
+			}
+			var wantTags int
+			for _, tag := range test.tags {
+				if tag.value != "" {
+					wantTags++
+				}
+			}
+			if len(tags) != wantTags || len(fields) != len(test.fields) {
+				t.Errorf("got %d tags and %d fields from %q, want %d and %d", len(tags), len(fields), line.String(), wantTags, len(test.fields))
+			}
+		})
+	}
+}
+
+func TestAppendDocumentNonFinite(t *testing.T) {
+	var document bytes.Buffer
+	err := appendDocument(&document, "m", []tag{{"folder_id", "a"}}, []field{
+		{"ratio", math.NaN()},
+		{"rate", math.Inf(1)},
+		{"value", 1.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	err = json.Unmarshal(document.Bytes(), &decoded)
+	if err != nil {
+		t.Fatalf("invalid JSON %q: %s", document.String(), err)
+	}
+	want := map[string]interface{}{"name": "m", "folder_id": "a", "value": 1.5}
+	if fmt.Sprint(decoded) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", decoded, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// renameKinds are the kinds of names that can be renamed. A rename without a
+// kind applies to all of them.
+var renameKinds = []string{"measurement", "tag", "field"}
+
+// renameMap maps kind to old name to new name.
+type renameMap map[string]map[string]string
+
+func (r renameMap) String() string {
+	var renames []string
+	for kind, names := range r {
+		for from, to := range names {
+			renames = append(renames, fmt.Sprintf("%s:%s=%s", kind, from, to))
+		}
+	}
+	return strings.Join(renames, ", ")
+}
+
+func (r renameMap) Set(value string) error {
+	kinds := renameKinds
+	if i := strings.Index(value, ":"); i >= 0 {
+		kinds = []string{value[:i]}
+		value = value[i+1:]
+		valid := false
+		for _, kind := range renameKinds {
+			valid = valid || kind == kinds[0]
+		}
+		if !valid {
+			return fmt.Errorf("unknown kind %s, must be one of %s", kinds[0], strings.Join(renameKinds, ", "))
+		}
+	}
+	i := strings.Index(value, "=")
+	if i <= 0 || i == len(value)-1 {
+		return fmt.Errorf("rename must be in \"[kind:]old=new\" format")
+	}
+	for _, kind := range kinds {
+		if r[kind] == nil {
+			r[kind] = make(map[string]string)
+		}
+		r[kind][value[:i]] = value[i+1:]
+	}
+	return nil
+}
+
+var renamesFlag = make(renameMap)
+
+func init() {
+	flag.Var(renamesFlag, "rename", "Rename a measurement, tag or field in the output, in \"[kind:]old=new\" format, where kind is measurement, tag or field. Can be repeated.")
+}
+
+func rename(kind string, name string) string {
+	if renamed, ok := renamesFlag[kind][name]; ok {
+		return renamed
+	}
+	return name
+}
+
+// renameSeries applies -rename to a measurement, returning copies of the tags
+// and fields.
+func renameSeries(measurement string, tags []tag, fields []field) (string, []tag, []field) {
+	renamedTags := make([]tag, len(tags))
+	for i, t := range tags {
+		renamedTags[i] = tag{rename("tag", t.key), t.value}
+	}
+	renamedFields := make([]field, len(fields))
+	for i, f := range fields {
+		renamedFields[i] = field{rename("field", f.key), f.value}
+	}
+	return rename("measurement", measurement), renamedTags, renamedFields
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var stateFileFlag = flag.String("state-file", "", "JSON file used to keep state between runs, for example the position in the Syncthing log")
+
+// instanceState is the part of the state file belonging to one instance.
+type instanceState struct {
+	LogSince string                  `json:"logSince,omitempty"`
+	Folders  map[string]*folderState `json:"folders,omitempty"`
+	Series   map[string]*seriesState `json:"series,omitempty"`
+	Events   *eventState             `json:"events,omitempty"`
+	EventAPI *eventAPIState          `json:"eventAPI,omitempty"`
+	Alerts   map[string]*alertState  `json:"alerts,omitempty"`
+}
+
+// folderState is the folder status seen on the previous run.
+type folderState struct {
+	NeedBytes    int64     `json:"needBytes"`
+	NeedItems    int64     `json:"needItems"`
+	At           time.Time `json:"at"`
+	LastProgress time.Time `json:"lastProgress"`
+}
+
+// seriesState is the last emitted value of a series, used by -only-changed.
+type seriesState struct {
+	Hash uint64    `json:"hash"`
+	At   time.Time `json:"at"`
+}
+
+var state = make(map[string]*instanceState)
+var stateMutex sync.Mutex
+
+func loadState() error {
+	if *stateFileFlag == "" {
+		return nil
+	}
+	contents, err := ioutil.ReadFile(*stateFileFlag)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("unable to read state file: %s", err)
+	}
+	err = json.Unmarshal(contents, &state)
+	if err != nil {
+		return fmt.Errorf("invalid state file: %s", err)
+	}
+	return nil
+}
+
+// saveState writes the state file through a temporary file, so an
+// interrupted run does not leave a truncated file behind.
+func saveState() error {
+	if *stateFileFlag == "" {
+		return nil
+	}
+	stateMutex.Lock()
+	contents, err := json.Marshal(state)
+	stateMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("unable to serialize state: %s", err)
+	}
+	tmpFile := *stateFileFlag + ".tmp"
+	err = ioutil.WriteFile(tmpFile, contents, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %s", err)
+	}
+	err = os.Rename(tmpFile, *stateFileFlag)
+	if err != nil {
+		return fmt.Errorf("unable to write state file: %s", err)
+	}
+	return nil
+}
+
+// stateKey identifies an instance in the state file. Discovered instances are
+// told apart by their tags, the single -server instance by its URLs.
+func (inst *instance) stateKey() string {
+	if len(inst.tags) == 0 {
+		return strings.Join(inst.servers, ",")
+	}
+	var parts []string
+	for _, t := range inst.tags {
+		parts = append(parts, t.key+"="+t.value)
+	}
+	return strings.Join(parts, ",")
+}
+
+// updateState calls update with the state of the instance while holding the
+// state lock.
+func (inst *instance) updateState(update func(*instanceState)) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	key := inst.stateKey()
+	instState, ok := state[key]
+	if !ok {
+		instState = &instanceState{}
+		state[key] = instState
+	}
+	update(instState)
+}
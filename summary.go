@@ -0,0 +1,115 @@
+package main
+
+import (
+	"flag"
+	"sort"
+	"sync"
+)
+
+var summaryOnlyFlag = flag.Bool("summary-only", false, "Emit only aggregates and the -top-n folders and devices that need the most data, instead of series for every folder, device and connection")
+var maxSeriesFlag = flag.Int("max-series", 0, "Switch to -summary-only for instances with more folders and devices than this. 0 disables the limit.")
+var topNFlag = flag.Int("top-n", 10, "Number of folders and devices emitted in summary mode")
+
+// entityTagKeys are the tags identifying a single folder, device or
+// connection. Measurements carrying them are held back in summary mode.
+var entityTagKeys = map[string]bool{
+	"folder_id": true,
+	"device_id": true,
+	"client_id": true,
+}
+
+// offenderScoreFields tells which field ranks the series of a measurement in
+// summary mode. Series of other measurements are dropped.
+var offenderScoreFields = map[string]string{
+	"syncthing_folder":            "need_bytes",
+	"syncthing_folder_completion": "need_bytes",
+	"syncthing_device_need":       "total_need_bytes",
+}
+
+type heldSeries struct {
+	tags   []tag
+	fields []field
+	score  float64
+}
+
+// summary holds back per-entity series of an instance in summary mode.
+type summary struct {
+	sync.Mutex
+	series map[string][]heldSeries
+}
+
+func isEntitySeries(tags []tag) bool {
+	for _, t := range tags {
+		if entityTagKeys[t.key] && t.value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func fieldScore(fields []field, key string) (float64, bool) {
+	for _, f := range fields {
+		if f.key != key {
+			continue
+		}
+		switch v := f.value.(type) {
+		case int:
+			return float64(v), true
+		case int64:
+			return float64(v), true
+		case float64:
+			return v, true
+		}
+	}
+	return 0, false
+}
+
+// hold keeps a series if it can be an offender, and drops it otherwise.
+func (s *summary) hold(measurement string, tags []tag, fields []field) {
+	scoreField, ok := offenderScoreFields[measurement]
+	if !ok {
+		return
+	}
+	score, ok := fieldScore(fields, scoreField)
+	if !ok || score <= 0 {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	if s.series == nil {
+		s.series = make(map[string][]heldSeries)
+	}
+	s.series[measurement] = append(s.series[measurement], heldSeries{tags, fields, score})
+}
+
+// summaryMode tells whether the instance is collected in summary mode.
+func summaryMode(inst *instance) bool {
+	if *summaryOnlyFlag {
+		return true
+	}
+	if *maxSeriesFlag == 0 {
+		return false
+	}
+	config, err := inst.config()
+	if err != nil {
+		return false
+	}
+	return len(config.Folders)+len(config.Devices) > *maxSeriesFlag
+}
+
+// emitOffenders emits the top -top-n held series of every measurement.
+func (inst *instance) emitOffenders() {
+	inst.summary.Lock()
+	held := inst.summary.series
+	inst.summary.series = nil
+	inst.summary.Unlock()
+	for measurement, series := range held {
+		sort.Slice(series, func(i, j int) bool { return series[i].score > series[j].score })
+		if len(series) > *topNFlag {
+			series = series[:*topNFlag]
+		}
+		for _, s := range series {
+			inst.writeSeries(measurement, s.tags, s.fields)
+		}
+	}
+}
@@ -1,260 +1,2373 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
+type FolderDeviceConfig struct {
+	DeviceID string `json:"deviceID"`
+}
+
 type FolderConfig struct {
-	ID              string `json:"id"`
-	Label           string `json:"label"`
-	RescanIntervalS int    `json:"rescanIntervalS"`
-	Type            string `json:"type"`
+	ID              string               `json:"id"`
+	Label           string               `json:"label"`
+	RescanIntervalS int                  `json:"rescanIntervalS"`
+	Type            string               `json:"type"`
+	Devices         []FolderDeviceConfig `json:"devices"`
+	Paused          bool                 `json:"paused"`
+	Path            string               `json:"path"`
+	MarkerName      string               `json:"markerName"`
+	Versioning      VersioningConfig     `json:"versioning"`
+
+	FsWatcherEnabled    bool    `json:"fsWatcherEnabled"`
+	FsWatcherDelayS     float64 `json:"fsWatcherDelayS"`
+	Copiers             int     `json:"copiers"`
+	PullerMaxPendingKiB int     `json:"pullerMaxPendingKiB"`
+	MaxConflicts        int     `json:"maxConflicts"`
+	MinDiskFree         struct {
+		Value float64 `json:"value"`
+		Unit  string  `json:"unit"`
+	} `json:"minDiskFree"`
+}
+
+type VersioningConfig struct {
+	Type   string            `json:"type"`
+	Params map[string]string `json:"params"`
+	FsPath string            `json:"fsPath"`
+}
+
+type FolderStats struct {
+	Errors            int64     `json:"errors"`
+	GlobalBytes       int64     `json:"globalBytes"`
+	GlobalDeleted     int64     `json:"globalDeleted"`
+	GlobalDirectories int64     `json:"globalDirectories"`
+	GlobalFiles       int64     `json:"globalFiles"`
+	GlobalSymlinks    int64     `json:"globalSymlinks"`
+	GlobalTotalItems  int64     `json:"globalTotalItems"`
+	InSyncBytes       int64     `json:"inSyncBytes"`
+	InSyncFiles       int64     `json:"inSyncFiles"`
+	LocalBytes        int64     `json:"localBytes"`
+	LocalDeleted      int64     `json:"localDeleted"`
+	LocalDirectories  int64     `json:"localDirectories"`
+	LocalFiles        int64     `json:"localFiles"`
+	LocalSymlinks     int64     `json:"localSymlinks"`
+	LocalTotalItems   int64     `json:"localTotalItems"`
+	NeedBytes         int64     `json:"needBytes"`
+	NeedDeletes       int64     `json:"needDeletes"`
+	NeedDirectories   int64     `json:"needDirectories"`
+	NeedFiles         int64     `json:"needFiles"`
+	NeedSymlinks      int64     `json:"needSymlinks"`
+	NeedTotalItems    int64     `json:"needTotalItems"`
+	PullErrors        int64     `json:"pullErrors"`
+	State             string    `json:"state"`
+	StateChanged      time.Time `json:"stateChanged"`
+
+	ReceiveOnlyChangedBytes       int64 `json:"receiveOnlyChangedBytes"`
+	ReceiveOnlyChangedDeletes     int64 `json:"receiveOnlyChangedDeletes"`
+	ReceiveOnlyChangedDirectories int64 `json:"receiveOnlyChangedDirectories"`
+	ReceiveOnlyChangedFiles       int64 `json:"receiveOnlyChangedFiles"`
+	ReceiveOnlyChangedSymlinks    int64 `json:"receiveOnlyChangedSymlinks"`
+	ReceiveOnlyTotalItems         int64 `json:"receiveOnlyTotalItems"`
+}
+
+// folderStates maps db/status folder states to the numeric values emitted in
+// the state field. Unknown states are emitted as -1.
+var folderStates = map[string]int{
+	"idle":           0,
+	"scanning":       1,
+	"scan-waiting":   2,
+	"sync-waiting":   3,
+	"sync-preparing": 4,
+	"syncing":        5,
+	"cleaning":       6,
+	"clean-waiting":  7,
+	"error":          8,
+	"paused":         9,
+}
+
+func folderStateCode(state string) int {
+	if code, ok := folderStates[state]; ok {
+		return code
+	}
+	return -1
+}
+
+type Report struct {
+	NumFolders     int     `json:"numFolders"`
+	NumDevices     int     `json:"numDevices"`
+	TotalFiles     int     `json:"totFiles"`
+	TotalMiB       int     `json:"totMiB"`
+	MaxFolderMiB   int     `json:"folderMaxMiB"`
+	Sha256Perf     float64 `json:"sha256Perf"`
+	HashPerf       float64 `json:"hashPerf"`
+	Uptime         int     `json:"uptime"`
+	MemoryUsageMiB int     `json:"memoryUsageMiB"`
+
+	TransportStats       map[string]int `json:"transportStats"`
+	UsesRateLimit        bool           `json:"usesRateLimit"`
+	UpgradeAllowedManual bool           `json:"upgradeAllowedManual"`
+	UpgradeAllowedAuto   bool           `json:"upgradeAllowedAuto"`
+	RescanIntervals      []int          `json:"rescanIntvs"`
+	FolderUses           struct {
+		SendOnly            int `json:"sendonly"`
+		SendReceive         int `json:"sendreceive"`
+		ReceiveOnly         int `json:"receiveonly"`
+		IgnorePerms         int `json:"ignorePerms"`
+		IgnoreDelete        int `json:"ignoreDelete"`
+		AutoNormalize       int `json:"autoNormalize"`
+		SimpleVersioning    int `json:"simpleVersioning"`
+		ExternalVersioning  int `json:"externalVersioning"`
+		StaggeredVersioning int `json:"staggeredVersioning"`
+		TrashcanVersioning  int `json:"trashcanVersioning"`
+	} `json:"folderUses"`
+	FolderUsesV3 struct {
+		FsWatcherEnabled     int `json:"fsWatcherEnabled"`
+		ScanProgressDisabled int `json:"scanProgressDisabled"`
+		ConflictsDisabled    int `json:"conflictsDisabled"`
+		ConflictsUnlimited   int `json:"conflictsUnlimited"`
+		DisableTempIndexes   int `json:"disableTempIndexes"`
+	} `json:"folderUsesV3"`
+	DeviceUses struct {
+		Introducer       int `json:"introducer"`
+		CustomCertName   int `json:"customCertName"`
+		CompressAlways   int `json:"compressAlways"`
+		CompressMetadata int `json:"compressMetadata"`
+		CompressNever    int `json:"compressNever"`
+		DynamicAddr      int `json:"dynamicAddr"`
+		StaticAddr       int `json:"staticAddr"`
+	} `json:"deviceUses"`
+	IgnoreStats struct {
+		Lines       int `json:"lines"`
+		Inverts     int `json:"inverts"`
+		Folded      int `json:"folded"`
+		Deletable   int `json:"deletable"`
+		Rooted      int `json:"rooted"`
+		Includes    int `json:"includes"`
+		DoubleStars int `json:"doubleStars"`
+		Stars       int `json:"stars"`
+	} `json:"ignoreStats"`
+	Announce struct {
+		GlobalEnabled     bool `json:"globalEnabled"`
+		LocalEnabled      bool `json:"localEnabled"`
+		DefaultServersDNS int  `json:"defaultServersDNS"`
+		DefaultServersIP  int  `json:"defaultServersIP"`
+		OtherServers      int  `json:"otherServers"`
+	} `json:"announce"`
+	Relays struct {
+		Enabled        bool `json:"enabled"`
+		DefaultServers int  `json:"defaultServers"`
+		OtherServers   int  `json:"otherServers"`
+	} `json:"relays"`
+}
+
+// Syncthing rescans folders hourly unless configured otherwise.
+const defaultRescanIntervalS = 3600
+
+// ConnectionPathItem is a single underlying connection to a device. Newer
+// Syncthing versions can keep several of them open per device.
+type ConnectionPathItem struct {
+	Address       string `json:"address"`
+	InBytesTotal  int64  `json:"inBytesTotal"`
+	OutBytesTotal int64  `json:"outBytesTotal"`
+	Type          string `json:"type"`
+}
+
+type ConnectionStatItem struct {
+	Address       string               `json:"address"`
+	At            time.Time            `json:"at"`
+	ClientVersion string               `json:"clientVersion"`
+	Connected     bool                 `json:"connected"`
+	Crypto        string               `json:"crypto"`
+	InBytesTotal  int64                `json:"inBytesTotal"`
+	OutBytesTotal int64                `json:"outBytesTotal"`
+	Paused        bool                 `json:"paused"`
+	Type          string               `json:"type"`
+	IsLocal       bool                 `json:"isLocal"`
+	StartedAt     time.Time            `json:"startedAt"`
+	Primary       *ConnectionPathItem  `json:"primary"`
+	Secondary     []ConnectionPathItem `json:"secondary"`
+}
+
+type Connections struct {
+	Total       ConnectionStatItem            `json:"total"`
+	Connections map[string]ConnectionStatItem `json:"connections"`
+}
+
+type DeviceConfig struct {
+	DeviceID  string   `json:"deviceID"`
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+	Paused    bool     `json:"paused"`
+
+	Introducer        bool   `json:"introducer"`
+	AutoAcceptFolders bool   `json:"autoAcceptFolders"`
+	Compression       string `json:"compression"`
+	Untrusted         bool   `json:"untrusted"`
+}
+
+type DeviceStatItem struct {
+	LastSeen                time.Time `json:"lastSeen"`
+	LastConnectionDurationS float64   `json:"lastConnectionDurationS"`
+}
+
+type Devices map[string]DeviceStatItem
+
+type FolderStatItem struct {
+	LastScan time.Time `json:"lastScan"`
+}
+
+type Folders map[string]FolderStatItem
+
+type RemoteNeed struct {
+	Files []struct {
+		Size int64 `json:"size"`
+	} `json:"files"`
+}
+
+const remoteNeedPageSize = 1000
+
+type FolderIgnores struct {
+	Ignore   []string `json:"ignore"`
+	Expanded []string `json:"expanded"`
+	Error    *string  `json:"error"`
+}
+
+type FolderErrors struct {
+	Errors []struct {
+		Path  string `json:"path"`
+		Error string `json:"error"`
+	} `json:"errors"`
+}
+
+type FolderNeed struct {
+	Progress []json.RawMessage `json:"progress"`
+	Queued   []json.RawMessage `json:"queued"`
+	Rest     []json.RawMessage `json:"rest"`
+}
+
+type SystemStatus struct {
+	Alloc            int64             `json:"alloc"`
+	Sys              int64             `json:"sys"`
+	Goroutines       int               `json:"goroutines"`
+	CPUPercent       float64           `json:"cpuPercent"`
+	MyID             string            `json:"myID"`
+	Uptime           int               `json:"uptime"`
+	StartTime        time.Time         `json:"startTime"`
+	DiscoveryEnabled bool              `json:"discoveryEnabled"`
+	DiscoveryMethods int               `json:"discoveryMethods"`
+	DiscoveryErrors  map[string]string `json:"discoveryErrors"`
+	DiscoveryStatus  map[string]struct {
+		Error *string `json:"error"`
+	} `json:"discoveryStatus"`
+
+	LastDialStatus map[string]struct {
+		When  time.Time `json:"when"`
+		Error *string   `json:"error"`
+	} `json:"lastDialStatus"`
+
+	ConnectionServiceStatus map[string]struct {
+		Error        *string  `json:"error"`
+		LANAddresses []string `json:"lanAddresses"`
+		WANAddresses []string `json:"wanAddresses"`
+	} `json:"connectionServiceStatus"`
+}
+
+type SystemVersion struct {
+	Arch     string `json:"arch"`
+	Codename string `json:"codename"`
+	OS       string `json:"os"`
+	Version  string `json:"version"`
+}
+
+type SystemErrors struct {
+	Errors []struct {
+		When    time.Time `json:"when"`
+		Message string    `json:"message"`
+	} `json:"errors"`
+}
+
+type SystemLog struct {
+	Messages []struct {
+		When    time.Time `json:"when"`
+		Message string    `json:"message"`
+		Level   int       `json:"level"`
+	} `json:"messages"`
+}
+
+// Log levels used by rest/system/log.
+const (
+	logLevelInfo = 2
+	logLevelWarn = 3
+)
+
+type FolderCompletion struct {
+	Completion  float64 `json:"completion"`
+	GlobalBytes int64   `json:"globalBytes"`
+	GlobalItems int64   `json:"globalItems"`
+	NeedBytes   int64   `json:"needBytes"`
+	NeedDeletes int64   `json:"needDeletes"`
+	NeedItems   int64   `json:"needItems"`
+	RemoteState string  `json:"remoteState"`
+}
+
+type PendingDevices map[string]struct {
+	Time    time.Time `json:"time"`
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+}
+
+type PendingFolders map[string]struct {
+	OfferedBy map[string]struct {
+		Time  time.Time `json:"time"`
+		Label string    `json:"label"`
+	} `json:"offeredBy"`
+}
+
+type DiscoveryCache map[string]struct {
+	Addresses []string `json:"addresses"`
+}
+
+type UpgradeInfo struct {
+	Latest     string `json:"latest"`
+	MajorNewer bool   `json:"majorNewer"`
+	Newer      bool   `json:"newer"`
+	Running    string `json:"running"`
+}
+
+// Config is the part of rest/config used by the collectors.
+type Config struct {
+	Version int            `json:"version"`
+	Folders []FolderConfig `json:"folders"`
+	Devices []DeviceConfig `json:"devices"`
+	Options Options        `json:"options"`
+}
+
+type Options struct {
+	GlobalAnnounceEnabled bool `json:"globalAnnounceEnabled"`
+	LocalAnnounceEnabled  bool `json:"localAnnounceEnabled"`
+	RelaysEnabled         bool `json:"relaysEnabled"`
+	NATEnabled            bool `json:"natEnabled"`
+	MaxSendKbps           int  `json:"maxSendKbps"`
+	MaxRecvKbps           int  `json:"maxRecvKbps"`
+	CrashReportingEnabled bool `json:"crashReportingEnabled"`
+	URAccepted            int  `json:"urAccepted"`
+}
+
+var server = flag.String("server", "http://localhost:8384", "Syncthing API URL. A comma-separated list of URLs for the same instance is tried in order on connection failure.")
+var apiKeyFlag = flag.String("apikey", "", "Syncthing API key")
+var useFullReportFlag = flag.Bool("use-full-report", false, "Add extra stats from svc/report. Somewhat slow/heavy.")
+var useNeedFlag = flag.Bool("use-need", false, "Add in-progress and queued item counts per folder from db/need. One extra request per folder.")
+var needPageSizeFlag = flag.Int("need-page-size", 100, "Number of needed items fetched from db/need. In-progress and queued counts are capped by this.")
+var useIgnoresFlag = flag.Bool("use-ignores", false, "Add ignore pattern counts per folder from db/ignores. One extra request per folder.")
+var folderErrorPathsFlag = flag.Int("folder-error-paths", 0, "Log up to this many failing paths per folder to stderr")
+var useUpgradeCheckFlag = flag.Bool("use-upgrade-check", false, "Add upgrade availability from system/upgrade. Makes Syncthing query its upgrade server.")
+var hideConnectionAddressFlag = flag.Bool("hide-connection-address", false, "Do not emit the remote address of connections")
+var folderTagFlag = flag.String("folder-tag", "both", "How folders are tagged: id, label or both. With label, folders without a label or sharing it with another folder are tagged with their ID.")
+var deviceIDFormatFlag = flag.String("device-id-format", "full", "How device IDs are tagged: full, short (7 characters) or both")
+var useCompletionFlag = flag.Bool("use-completion", false, "Add per-device folder completion from db/completion. One request per shared folder and device.")
+var useRemoteNeedFlag = flag.Bool("use-remote-need", false, "Add items and bytes needed by each remote device from db/remoteneed. Pages through every needed file; can be slow.")
+var useLogFlag = flag.Bool("use-log", false, "Add counts of INFO and WARNING lines from system/log. Use with -state-file to count only lines logged since the previous run.")
+var useConflictsFlag = flag.Bool("use-conflicts", false, "Add counts of sync conflict files per folder by walking the folder paths. Must run on the Syncthing host.")
+var useDiskUsageFlag = flag.Bool("use-disk-usage", false, "Add free and total disk space of each folder's filesystem. Must run on the Syncthing host.")
+var useMarkerCheckFlag = flag.Bool("use-marker-check", false, "Check that the folder marker exists in each folder path. Must run on the Syncthing host.")
+var stallTimeoutFlag = flag.Duration("stall-timeout", time.Hour, "With -state-file, a folder is reported as stalled when what it needs has not gone down for this long")
+var useVersionsSizeFlag = flag.Bool("use-versions-size", false, "Add size and file count of the versions directory of folders with versioning. Must run on the Syncthing host.")
+var startupGraceFlag = flag.Duration("startup-grace", 0, "Keep retrying the health check for this long when Syncthing is not up, for example 10s while it restarts after an upgrade")
+var minLastSeenFlag = flag.Duration("min-last-seen", 0, "Skip devices and connections last seen longer ago than this, for example 720h. 0 includes all.")
+var includeNeverSeenFlag = flag.Bool("include-never-seen", false, "Include devices and connections that have never been seen")
+var disableCompressionFlag = flag.Bool("disable-compression", false, "Turn off the gzip compression Go's HTTP client requests by default")
+var workersFlag = flag.Int("workers", 8, "Number of instances collected in parallel")
+var instanceTimeoutFlag = flag.Duration("instance-timeout", 0, "Give up collecting from an instance after this long, for example 4s to stay within the telegraf exec timeout. 0 disables the limit.")
+var versionFlag = flag.Bool("version", false, "Print the collector version and exit")
+
+// Set at build time with -ldflags "-X main.version=... -X main.commit=...".
+var version = "dev"
+var commit = "unknown"
+
+var tlsMinVersionFlag = flag.String("tls-min-version", "", "Minimum TLS version for HTTPS connections: 1.0, 1.1, 1.2 or 1.3")
+var tlsCipherSuitesFlag = flag.String("tls-cipher-suites", "", "Comma-separated list of allowed TLS cipher suites (Go crypto/tls names). Only affects TLS 1.2 and older.")
+
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(value string) error {
+	if i := strings.Index(value, ":"); i <= 0 {
+		return fmt.Errorf("header must be in \"Name: value\" format")
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+var headersFlag headerList
+
+func init() {
+	flag.Var(&headersFlag, "header", "Extra HTTP header added to every API request, in \"Name: value\" format. Can be repeated.")
+}
+
+func addCustomHeaders(req *http.Request) {
+	for _, header := range headersFlag {
+		i := strings.Index(header, ":")
+		req.Header.Add(strings.TrimSpace(header[:i]), strings.TrimSpace(header[i+1:]))
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var httpClient = &http.Client{
+	Timeout: 2 * time.Second,
+}
+
+func makeTLSConfig(minVersion string, cipherSuites string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if minVersion != "" {
+		version, ok := tlsVersions[minVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version: %s", minVersion)
+		}
+		config.MinVersion = version
+	}
+	if cipherSuites != "" {
+		available := make(map[string]uint16)
+		for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+			available[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(cipherSuites, ",") {
+			id, ok := available[strings.TrimSpace(name)]
+			if !ok {
+				return nil, fmt.Errorf("unknown TLS cipher suite: %s", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+	return config, nil
+}
+
+type instance struct {
+	servers  []string
+	apiKey   string
+	user     string
+	password string
+	tags     []tag
+
+	loginOnce  sync.Once
+	loginErr   error
+	basicAuth  bool
+	cookies    []*http.Cookie
+	csrfHeader string
+	csrfToken  string
+
+	serverMutex  sync.Mutex
+	activeServer int
+
+	requestStatsMutex sync.Mutex
+	requestStats      map[requestKey]*requestStat
+
+	configOnce  sync.Once
+	configValue *Config
+	configErr   error
+
+	statusOnce  sync.Once
+	statusValue *SystemStatus
+	statusErr   error
+
+	discoveryOnce  sync.Once
+	discoveryValue DiscoveryCache
+	discoveryErr   error
+
+	folderLabelsOnce     sync.Once
+	duplicateLabelsValue map[string]bool
+
+	folderStatusMutex sync.Mutex
+	folderStatuses    map[string]*folderStatus
+
+	// ctx limits the time spent collecting from the instance.
+	ctx context.Context
+
+	summaryMode bool
+	summary     summary
+
+	observed observations
+
+	alertsMutex sync.Mutex
+	alerts      []alertNotification
+}
+
+type requestKey struct {
+	endpoint string
+	folder   string
+}
+
+type requestStat struct {
+	requests   int
+	failed     int
+	statusCode int
+	total      time.Duration
+	max        time.Duration
+}
+
+// recordRequest keeps track of the response times of API requests, which are
+// emitted by emitRequestStats.
+func (inst *instance) recordRequest(path string, statusCode int, duration time.Duration) {
+	key := requestKey{endpoint: path}
+	if i := strings.Index(path, "?"); i >= 0 {
+		key.endpoint = path[:i]
+		query, err := url.ParseQuery(path[i+1:])
+		if err == nil {
+			key.folder = query.Get("folder")
+		}
+	}
+	inst.requestStatsMutex.Lock()
+	defer inst.requestStatsMutex.Unlock()
+	if inst.requestStats == nil {
+		inst.requestStats = make(map[requestKey]*requestStat)
+	}
+	stat, ok := inst.requestStats[key]
+	if !ok {
+		stat = &requestStat{}
+		inst.requestStats[key] = stat
+	}
+	stat.requests++
+	if statusCode != http.StatusOK {
+		stat.failed++
+	}
+	stat.statusCode = statusCode
+	stat.total += duration
+	if duration > stat.max {
+		stat.max = duration
+	}
+}
+
+func (inst *instance) emitRequestStats() {
+	inst.requestStatsMutex.Lock()
+	defer inst.requestStatsMutex.Unlock()
+	for key, stat := range inst.requestStats {
+		inst.emit("syncthing_api", []tag{{"endpoint", key.endpoint}, {"folder_id", key.folder}}, []field{
+			{"requests", stat.requests},
+			{"failed_requests", stat.failed},
+			{"status_code", stat.statusCode},
+			{"response_time", stat.total.Seconds() / float64(stat.requests)},
+			{"max_response_time", stat.max.Seconds()},
+		})
+	}
+}
+
+// config returns the Syncthing configuration. It is fetched once per run and
+// shared by all collectors, so they all see the same folders and devices.
+func (inst *instance) config() (*Config, error) {
+	inst.configOnce.Do(func() {
+		resp, err := makeRequest(inst, "rest/config")
+		if err != nil {
+			inst.configErr = err
+			return
+		}
+		defer resp.Body.Close()
+		var config Config
+		err = decodeResponse(resp, &config)
+		if err != nil {
+			inst.configErr = fmt.Errorf("invalid response body: %s", err)
+			return
+		}
+		inst.configValue = &config
+	})
+	return inst.configValue, inst.configErr
+}
+
+// systemStatus returns rest/system/status, fetched once per run.
+func (inst *instance) systemStatus() (*SystemStatus, error) {
+	inst.statusOnce.Do(func() {
+		resp, err := makeRequest(inst, "rest/system/status")
+		if err != nil {
+			inst.statusErr = err
+			return
+		}
+		defer resp.Body.Close()
+		var status SystemStatus
+		err = decodeResponse(resp, &status)
+		if err != nil {
+			inst.statusErr = fmt.Errorf("invalid response body: %s", err)
+			return
+		}
+		inst.statusValue = &status
+	})
+	return inst.statusValue, inst.statusErr
+}
+
+// discoveryCache returns rest/system/discovery, fetched once per run.
+func (inst *instance) discoveryCache() (DiscoveryCache, error) {
+	inst.discoveryOnce.Do(func() {
+		resp, err := makeRequest(inst, "rest/system/discovery")
+		if err != nil {
+			inst.discoveryErr = err
+			return
+		}
+		defer resp.Body.Close()
+		var cache DiscoveryCache
+		err = decodeResponse(resp, &cache)
+		if err != nil {
+			inst.discoveryErr = fmt.Errorf("invalid response body: %s", err)
+			return
+		}
+		inst.discoveryValue = cache
+	})
+	return inst.discoveryValue, inst.discoveryErr
+}
+
+// duplicateFolderLabels returns the labels shared by several folders.
+func (inst *instance) duplicateFolderLabels() map[string]bool {
+	inst.folderLabelsOnce.Do(func() {
+		inst.duplicateLabelsValue = make(map[string]bool)
+		config, err := inst.config()
+		if err != nil {
+			return
+		}
+		labelCounts := make(map[string]int)
+		for _, folder := range config.Folders {
+			labelCounts[folder.Label]++
+		}
+		for label, count := range labelCounts {
+			if count > 1 {
+				inst.duplicateLabelsValue[label] = true
+			}
+		}
+	})
+	return inst.duplicateLabelsValue
+}
+
+// folderStatus is rest/db/status of a folder.
+type folderStatus struct {
+	once  sync.Once
+	value *FolderStats
+	err   error
+}
+
+// folderStatus returns rest/db/status of a folder, fetched once per run.
+func (inst *instance) folderStatus(folderID string) (*FolderStats, error) {
+	inst.folderStatusMutex.Lock()
+	if inst.folderStatuses == nil {
+		inst.folderStatuses = make(map[string]*folderStatus)
+	}
+	status, ok := inst.folderStatuses[folderID]
+	if !ok {
+		status = &folderStatus{}
+		inst.folderStatuses[folderID] = status
+	}
+	inst.folderStatusMutex.Unlock()
+	status.once.Do(func() {
+		resp, err := makeRequest(inst, apiPath("rest/db/status", url.Values{"folder": {folderID}}))
+		if err != nil {
+			status.err = err
+			return
+		}
+		defer resp.Body.Close()
+		var stats FolderStats
+		err = decodeResponse(resp, &stats)
+		if err != nil {
+			status.err = fmt.Errorf("invalid response body: %s", err)
+			return
+		}
+		status.value = &stats
+	})
+	return status.value, status.err
+}
+
+func (inst *instance) context() context.Context {
+	if inst.ctx == nil {
+		return context.Background()
+	}
+	return inst.ctx
+}
+
+// server returns the URL currently used for the instance.
+func (inst *instance) server() string {
+	inst.serverMutex.Lock()
+	defer inst.serverMutex.Unlock()
+	return inst.servers[inst.activeServer]
+}
+
+// failover moves to the next URL candidate after a connection failure, unless
+// a concurrent request has already done so.
+func (inst *instance) failover(failedServer string) {
+	inst.serverMutex.Lock()
+	defer inst.serverMutex.Unlock()
+	if inst.servers[inst.activeServer] == failedServer {
+		inst.activeServer = (inst.activeServer + 1) % len(inst.servers)
+	}
+}
+
+func (inst *instance) emit(measurement string, tags []tag, fields []field) {
+	inst.evaluateAlerts(measurement, tags, fields)
+	if inst.summaryMode && isEntitySeries(tags) {
+		inst.summary.hold(measurement, tags, fields)
+		return
+	}
+	inst.writeSeries(measurement, tags, fields)
+}
+
+func (inst *instance) writeSeries(measurement string, tags []tag, fields []field) {
+	inst.write(measurement, tags, fields, *onlyChangedFlag)
+}
+
+// write adds the instance tags to a series and writes it out. With
+// onlyChanged, the series is compared to the previous run as it would be
+// written.
+func (inst *instance) write(measurement string, tags []tag, fields []field, onlyChanged bool) {
+	var duplicateLabels map[string]bool
+	for _, t := range tags {
+		if t.key == "folder_label" && *folderTagFlag == "label" {
+			duplicateLabels = inst.duplicateFolderLabels()
+		}
+	}
+	tags, fields = folderTags(tags, fields, duplicateLabels)
+	allTags := append([]tag{}, inst.tags...)
+	for _, t := range tags {
+		allTags = append(allTags, deviceIDTags(t)...)
+	}
+	allTags, fields = selectFields(measurement, allTags, fields)
+	if len(fields) == 0 {
+		return
+	}
+	if onlyChanged && !inst.changedSinceEmitted(measurement, allTags, fields) {
+		return
+	}
+	writeLine(measurement, allTags, fields)
+}
+
+// folderTags applies -folder-tag. With id, the label moves to a string field,
+// so that relabeling a folder does not start a new series. With label, the
+// ID is used for folders without a label.
+func folderTags(tags []tag, fields []field, duplicateLabels map[string]bool) ([]tag, []field) {
+	if *folderTagFlag == "both" {
+		return tags, fields
+	}
+	var id, label string
+	for _, t := range tags {
+		switch t.key {
+		case "folder_id":
+			id = t.value
+		case "folder_label":
+			label = t.value
+		}
+	}
+	if id == "" {
+		return tags, fields
+	}
+	var placed []tag
+	for _, t := range tags {
+		switch {
+		case t.key == "folder_label" && *folderTagFlag == "id":
+			if label != "" {
+				fields = append(fields, field{"folder_label", label})
+			}
+		case t.key == "folder_id" && *folderTagFlag == "label":
+			if label == "" {
+				placed = append(placed, tag{"folder_label", id})
+			}
+		case t.key == "folder_label" && *folderTagFlag == "label" && duplicateLabels[label]:
+			// Folders sharing a label would write over each other.
+			placed = append(placed, tag{"folder_label", id})
+		default:
+			placed = append(placed, t)
+		}
+	}
+	return placed, fields
+}
+
+// deviceIDTagKeys are the tags holding a device ID, which are emitted
+// according to -device-id-format.
+var deviceIDTagKeys = map[string]bool{
+	"device_id": true,
+	"client_id": true,
+	"my_id":     true,
+}
+
+// shortDeviceID returns the short form of a device ID, as shown by Syncthing
+// in logs and the GUI.
+func shortDeviceID(deviceID string) string {
+	if len(deviceID) < 7 {
+		return deviceID
+	}
+	return deviceID[:7]
+}
+
+func deviceIDTags(t tag) []tag {
+	if !deviceIDTagKeys[t.key] {
+		return []tag{t}
+	}
+	switch *deviceIDFormatFlag {
+	case "short":
+		return []tag{{t.key, shortDeviceID(t.value)}}
+	case "both":
+		return []tag{t, {strings.TrimSuffix(t.key, "_id") + "_short_id", shortDeviceID(t.value)}}
+	}
+	return []tag{t}
+}
+
+const maxErrorBodyLength = 200
+
+const healthRetryInterval = time.Second
+
+// apiPath adds query parameters to an API endpoint path.
+func apiPath(endpoint string, query url.Values) string {
+	return endpoint + "?" + query.Encode()
+}
+
+// apiURL joins a server URL, which may include a base path when Syncthing is
+// behind a reverse proxy, and an API path.
+func apiURL(server string, path string) string {
+	return strings.TrimSuffix(server, "/") + "/" + strings.TrimPrefix(path, "/")
+}
+
+func makeRequest(inst *instance, url string) (*http.Response, error) {
+	if inst.apiKey == "" && inst.user != "" {
+		inst.loginOnce.Do(inst.login)
+		if inst.loginErr != nil {
+			return nil, inst.loginErr
+		}
+	}
+	resp, err := sendRequest(inst, url, true)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// Syncthing explains most errors in a short plain text body.
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodyLength))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned %s: %s", url, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sendRequest sends a GET request to the instance, failing over to the next
+// server URL on connection failures.
+func sendRequest(inst *instance, path string, authenticate bool) (*http.Response, error) {
+	return sendRequestBody(inst, "GET", path, nil, authenticate)
+}
+
+// sendRequestBody sends a request with an optional JSON body to the instance,
+// failing over like sendRequest.
+func sendRequestBody(inst *instance, method string, path string, body []byte, authenticate bool) (*http.Response, error) {
+	var lastErr error
+	for range inst.servers {
+		server := inst.server()
+		var bodyReader io.Reader
+		if body != nil {
+			bodyReader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(inst.context(), method, apiURL(server, path), bodyReader)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create HTTP request: %s", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		addCustomHeaders(req)
+		if authenticate {
+			if inst.apiKey != "" {
+				req.Header.Add("X-API-Key", inst.apiKey)
+			} else if inst.user != "" {
+				inst.authenticate(req)
+			}
+		}
+		start := time.Now()
+		resp, err := httpClient.Do(req)
+		if err == nil {
+			inst.recordRequest(path, resp.StatusCode, time.Since(start))
+			return resp, nil
+		}
+		lastErr = err
+		inst.failover(server)
+	}
+	return nil, fmt.Errorf("HTTP request failed: %s", lastErr)
+}
+
+// probeHealth queries the unauthenticated health endpoint.
+func probeHealth(inst *instance) (up bool, responseTime time.Duration, err error) {
+	start := time.Now()
+	resp, err := sendRequest(inst, "rest/noauth/health", false)
+	if err != nil {
+		return false, 0, err
+	}
+	defer resp.Body.Close()
+	responseTime = time.Since(start)
+	var health struct {
+		Status string `json:"status"`
+	}
+	err = decodeResponse(resp, &health)
+	if resp.StatusCode != http.StatusOK {
+		return false, responseTime, fmt.Errorf("health check returned %s", resp.Status)
+	}
+	if err != nil || health.Status != "OK" {
+		return false, responseTime, fmt.Errorf("health check failed: %s", health.Status)
+	}
+	return true, responseTime, nil
+}
+
+// checkHealth emits syncthing_up from the unauthenticated health endpoint and
+// returns whether Syncthing is up. While Syncthing restarts, for example after
+// an upgrade, the check is retried for up to -startup-grace.
+func checkHealth(inst *instance) bool {
+	deadline := time.Now().Add(*startupGraceFlag)
+	for {
+		up, responseTime, err := probeHealth(inst)
+		// syncthing_up is written on every run, also with -only-changed,
+		// so that it can be used to tell whether the collector runs.
+		if up {
+			fields := []field{
+				{"up", 1},
+				{"response_time", responseTime.Seconds()},
+			}
+			inst.evaluateAlerts("syncthing_up", nil, fields)
+			inst.write("syncthing_up", nil, fields, false)
+			return true
+		}
+		if time.Now().Add(healthRetryInterval).Before(deadline) {
+			select {
+			case <-time.After(healthRetryInterval):
+				continue
+			case <-inst.context().Done():
+			}
+		}
+		os.Stderr.Write([]byte(fmt.Sprintf("Failed: %s: %s\n", inst.server(), err)))
+		fields := []field{{"up", 0}}
+		if responseTime > 0 {
+			fields = append(fields, field{"response_time", responseTime.Seconds()})
+		}
+		inst.evaluateAlerts("syncthing_up", nil, fields)
+		inst.write("syncthing_up", nil, fields, false)
+		return false
+	}
+}
+
+func boolToInt(value bool) int {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+func emitConnectionPath(inst *instance, connectionId string, name string, path ConnectionPathItem) {
+	inst.emit("syncthing_connection_path", []tag{{"client_id", connectionId}, {"path", name}}, []field{
+		{"in_bytes", path.InBytesTotal},
+		{"out_bytes", path.OutBytesTotal},
+	})
+}
+
+// includeLastSeen tells whether a device or connection last seen at the given
+// time is emitted. Syncthing reports the epoch or the zero time for peers
+// never seen since the statistics were reset.
+func includeLastSeen(lastSeen time.Time) bool {
+	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	if !cutOffTime.Before(lastSeen) {
+		return *includeNeverSeenFlag
+	}
+	return *minLastSeenFlag == 0 || time.Since(lastSeen) <= *minLastSeenFlag
+}
+
+func handleSystemConnections(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	resp, err := makeRequest(inst, "rest/system/connections")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var stats Connections
+	err = decodeResponse(resp, &stats)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	inst.observeConnections(stats.Connections)
+	var direct, relayed, lan, wan int
+	for _, connectionStat := range stats.Connections {
+		if !connectionStat.Connected {
+			continue
+		}
+		if strings.HasPrefix(connectionStat.Type, "relay") {
+			relayed++
+		} else {
+			direct++
+		}
+		if connectionStat.IsLocal {
+			lan++
+		} else {
+			wan++
+		}
+	}
+	inst.emit("syncthing_connection_totals", nil, []field{
+		{"number_of_connections", len(stats.Connections)},
+		{"in_bytes", stats.Total.InBytesTotal},
+		{"out_bytes", stats.Total.OutBytesTotal},
+		{"paused", boolToInt(stats.Total.Paused)},
+		{"connections_direct", direct},
+		{"connections_relayed", relayed},
+		{"connections_lan", lan},
+		{"connections_wan", wan},
+	})
+
+	for connectionId, connectionStat := range stats.Connections {
+		if includeLastSeen(connectionStat.At) {
+			// This connection has likely been updated.
+			activeConnections := boolToInt(connectionStat.Connected)
+			if connectionStat.Connected {
+				activeConnections += len(connectionStat.Secondary)
+			}
+			connectionTags := []tag{
+				{"client_id", connectionId},
+				{"crypto", connectionStat.Crypto},
+			}
+			// Whether the connection is local is only known while connected.
+			if connectionStat.Connected {
+				connectionTags = append(connectionTags, tag{"is_local", strconv.FormatBool(connectionStat.IsLocal)})
+			}
+			connectionFields := []field{
+				{"connected", boolToInt(connectionStat.Connected)},
+				{"paused", boolToInt(connectionStat.Paused)},
+				{"in_bytes", connectionStat.InBytesTotal},
+				{"out_bytes", connectionStat.OutBytesTotal},
+				{"active_connections", activeConnections},
+			}
+			// The transport and client version change with reconnects and
+			// upgrades, so they are fields, which keeps the byte counters
+			// in one series.
+			if connectionStat.Type != "" {
+				connectionFields = append(connectionFields, field{"type", connectionStat.Type})
+			}
+			if connectionStat.ClientVersion != "" {
+				connectionFields = append(connectionFields, field{"client_version", connectionStat.ClientVersion})
+			}
+			if connectionStat.Connected && cutOffTime.Before(connectionStat.StartedAt) {
+				connectionFields = append(connectionFields, field{"connection_uptime_seconds", time.Since(connectionStat.StartedAt).Seconds()})
+			}
+			if connectionStat.Address != "" && !*hideConnectionAddressFlag {
+				connectionFields = append(connectionFields, field{"address", connectionStat.Address})
+			}
+			inst.emit("syncthing_connection", connectionTags, connectionFields)
+			if connectionStat.Connected && connectionStat.Primary != nil {
+				emitConnectionPath(inst, connectionId, "primary", *connectionStat.Primary)
+				for i, path := range connectionStat.Secondary {
+					emitConnectionPath(inst, connectionId, fmt.Sprintf("secondary-%d", i+1), path)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// uniqueDeviceNames returns the device names used in the device_name tag.
+// Devices without a name get their short device ID, and devices sharing a
+// name get their short device ID appended, so that the tag is never empty or
+// ambiguous.
+func uniqueDeviceNames(devices []DeviceConfig) map[string]string {
+	nameCounts := make(map[string]int)
+	for _, device := range devices {
+		nameCounts[device.Name]++
+	}
+	names := make(map[string]string)
+	for _, device := range devices {
+		switch {
+		case device.Name == "":
+			names[device.DeviceID] = shortDeviceID(device.DeviceID)
+		case nameCounts[device.Name] > 1:
+			names[device.DeviceID] = fmt.Sprintf("%s (%s)", device.Name, shortDeviceID(device.DeviceID))
+		default:
+			names[device.DeviceID] = device.Name
+		}
+	}
+	return names
+}
+
+func handleDevices(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	deviceConfigs := config.Devices
+
+	deviceNames := uniqueDeviceNames(deviceConfigs)
+	var devicePaused = make(map[string]bool)
+	var pausedDevices int
+	for _, device := range deviceConfigs {
+		devicePaused[device.DeviceID] = device.Paused
+		if device.Paused {
+			pausedDevices++
+		}
+	}
+
+	for _, device := range deviceConfigs {
+		inst.emit("syncthing_device_config", []tag{{"device_id", device.DeviceID}, {"device_name", deviceNames[device.DeviceID]}, {"compression", device.Compression}}, []field{
+			{"paused", boolToInt(device.Paused)},
+			{"introducer", boolToInt(device.Introducer)},
+			{"auto_accept_folders", boolToInt(device.AutoAcceptFolders)},
+			{"untrusted", boolToInt(device.Untrusted)},
+		})
+	}
+
+	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	statsResp, err := makeRequest(inst, "rest/stats/device")
+	if err != nil {
+		return err
+	}
+	defer statsResp.Body.Close()
+
+	var stats Devices
+	err = decodeResponse(statsResp, &stats)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	inst.emit("syncthing_device_totals", nil, []field{
+		{"number_of_devices", len(stats)},
+		{"paused_devices", pausedDevices},
+	})
+
+	for deviceId, deviceStat := range stats {
+		if !includeLastSeen(deviceStat.LastSeen) {
+			continue
+		}
+		var fields []field
+		if cutOffTime.Before(deviceStat.LastSeen) {
+			fields = append(fields,
+				field{"last_seen", deviceStat.LastSeen.Sub(cutOffTime).Seconds()},
+				field{"last_seen_seconds_ago", time.Since(deviceStat.LastSeen).Seconds()},
+			)
+		}
+		fields = append(fields,
+			field{"last_connection_duration", deviceStat.LastConnectionDurationS},
+			field{"paused", boolToInt(devicePaused[deviceId])},
+		)
+		inst.emit("syncthing_device", []tag{{"device_id", deviceId}, {"device_name", deviceNames[deviceId]}}, fields)
+	}
+	return nil
+}
+
+// folderTotals sums up the status of all folders for syncthing_folder_totals.
+type folderTotals struct {
+	sync.Mutex
+	needBytes   int64
+	pullErrors  int64
+	globalBytes int64
+	localBytes  int64
+	errors      int64
+
+	foldersInError int
+}
+
+func (t *folderTotals) add(stats FolderStats) {
+	t.Lock()
+	defer t.Unlock()
+	t.needBytes += stats.NeedBytes
+	t.pullErrors += stats.PullErrors
+	t.globalBytes += stats.GlobalBytes
+	t.localBytes += stats.LocalBytes
+	t.errors += stats.Errors
+	if stats.State == "error" || stats.Errors > 0 || stats.PullErrors > 0 {
+		t.foldersInError++
+	}
+}
+
+func handleFolderStats(inst *instance, folderConfig FolderConfig, totals *folderTotals, wg *sync.WaitGroup) {
+	defer wg.Done()
+	folderTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}, {"folder_type", folderConfig.Type}}
+	if folderConfig.Paused {
+		// Syncthing has no status for paused folders; emit what the
+		// configuration tells so the folder does not vanish.
+		inst.emit("syncthing_folder", folderTags, []field{
+			{"rescanInterval", folderConfig.RescanIntervalS},
+			{"state", folderStateCode("paused")},
+			{"paused", 1},
+		})
+		return
+	}
+	status, err := inst.folderStatus(folderConfig.ID)
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read status for %s: %s\n", folderConfig.ID, err)))
+		inst.emit("syncthing_folder", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	stats := *status
+	totals.add(stats)
+	inst.observeFolder(folderConfig.ID, stats)
+	fields := []field{
+		{"rescanInterval", folderConfig.RescanIntervalS},
+		{"errors", stats.Errors},
+		{"global_bytes", stats.GlobalBytes},
+		{"global_deleted", stats.GlobalDeleted},
+		{"global_directories", stats.GlobalDirectories},
+		{"global_files", stats.GlobalFiles},
+		{"global_symlinks", stats.GlobalSymlinks},
+		{"global_total_items", stats.GlobalTotalItems},
+		{"insync_bytes", stats.InSyncBytes},
+		{"insync_files", stats.InSyncFiles},
+		{"local_bytes", stats.LocalBytes},
+		{"local_deleted", stats.LocalDeleted},
+		{"local_directories", stats.LocalDirectories},
+		{"local_files", stats.LocalFiles},
+		{"local_symlinks", stats.LocalSymlinks},
+		{"local_total_items", stats.LocalTotalItems},
+		{"need_bytes", stats.NeedBytes},
+		{"need_deletes", stats.NeedDeletes},
+		{"need_directories", stats.NeedDirectories},
+		{"need_files", stats.NeedFiles},
+		{"need_symlinks", stats.NeedSymlinks},
+		{"need_total_items", stats.NeedTotalItems},
+		{"pull_errors", stats.PullErrors},
+		{"state", folderStateCode(stats.State)},
+		{"paused", boolToInt(folderConfig.Paused)},
+	}
+	if folderConfig.Type == "receiveonly" {
+		// Files changed locally on a receive-only folder.
+		fields = append(fields,
+			field{"receiveonly_changed_bytes", stats.ReceiveOnlyChangedBytes},
+			field{"receiveonly_changed_deletes", stats.ReceiveOnlyChangedDeletes},
+			field{"receiveonly_changed_directories", stats.ReceiveOnlyChangedDirectories},
+			field{"receiveonly_changed_files", stats.ReceiveOnlyChangedFiles},
+			field{"receiveonly_changed_symlinks", stats.ReceiveOnlyChangedSymlinks},
+			field{"receiveonly_total_items", stats.ReceiveOnlyTotalItems},
+		)
+	}
+	if !stats.StateChanged.IsZero() {
+		fields = append(fields, field{"seconds_in_state", time.Since(stats.StateChanged).Seconds()})
+	}
+	// An empty folder is complete.
+	completionPct := 100.0
+	if stats.GlobalBytes > 0 {
+		completionPct = 100 * float64(stats.InSyncBytes) / float64(stats.GlobalBytes)
+	}
+	fields = append(fields, field{"completion_pct", completionPct})
+	if *stateFileFlag != "" {
+		fields = append(fields, folderProgressFields(inst, folderConfig.ID, stats)...)
+	}
+	inst.emit("syncthing_folder", folderTags, fields)
+	if *useNeedFlag {
+		handleFolderNeed(inst, folderConfig, stats)
+	}
+	handleFolderErrors(inst, folderConfig, stats)
+	if *useIgnoresFlag {
+		handleFolderIgnores(inst, folderConfig)
+	}
+}
+
+// folderProgressFields compares the folder status to the previous run. The
+// estimated time to completion assumes the download rate since the previous
+// run stays the same. A folder is stalled when it needs something, but
+// neither the needed bytes nor items have gone down within -stall-timeout.
+func folderProgressFields(inst *instance, folderID string, stats FolderStats) []field {
+	now := time.Now()
+	var fields []field
+	inst.updateState(func(instState *instanceState) {
+		if instState.Folders == nil {
+			instState.Folders = make(map[string]*folderState)
+		}
+		current := &folderState{NeedBytes: stats.NeedBytes, NeedItems: stats.NeedTotalItems, At: now, LastProgress: now}
+		previous, ok := instState.Folders[folderID]
+		if ok && stats.NeedBytes > 0 && previous.NeedBytes > stats.NeedBytes {
+			rate := float64(previous.NeedBytes-stats.NeedBytes) / now.Sub(previous.At).Seconds()
+			fields = append(fields, field{"eta_seconds", float64(stats.NeedBytes) / rate})
+		}
+		needsSomething := stats.NeedBytes > 0 || stats.NeedTotalItems > 0
+		if ok && needsSomething && !previous.LastProgress.IsZero() {
+			madeProgress := stats.NeedBytes < previous.NeedBytes || stats.NeedTotalItems < previous.NeedItems
+			if !madeProgress {
+				current.LastProgress = previous.LastProgress
+			}
+		}
+		stalled := needsSomething && now.Sub(current.LastProgress) >= *stallTimeoutFlag
+		fields = append(fields, field{"stalled", boolToInt(stalled)})
+		instState.Folders[folderID] = current
+	})
+	return fields
+}
+
+func handleFolderIgnores(inst *instance, folderConfig FolderConfig) {
+	folderTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}}
+	resp, err := makeRequest(inst, apiPath("rest/db/ignores", url.Values{"folder": {folderConfig.ID}}))
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read ignores for %s: %s\n", folderConfig.ID, err)))
+		inst.emit("syncthing_folder_ignores", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	defer resp.Body.Close()
+	var ignores FolderIgnores
+	err = decodeResponse(resp, &ignores)
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s\n", err)))
+		inst.emit("syncthing_folder_ignores", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	inst.emit("syncthing_folder_ignores", folderTags, []field{
+		{"patterns", len(ignores.Ignore)},
+		{"expanded_patterns", len(ignores.Expanded)},
+		{"load_error", boolToInt(ignores.Error != nil && *ignores.Error != "")},
+	})
+}
+
+// folderErrorClasses maps error classes to substrings of the error messages
+// Syncthing (or the operating system) reports for failing items.
+var folderErrorClasses = []struct {
+	name     string
+	patterns []string
+}{
+	{"permission_denied", []string{"permission denied", "access is denied", "operation not permitted"}},
+	{"file_in_use", []string{"being used by another process", "file in use", "text file busy"}},
+	{"insufficient_space", []string{"insufficient space", "no space left on device", "not enough space", "disk quota exceeded"}},
+	{"case_conflict", []string{"case conflict", "different upper or lowercase characters"}},
+}
+
+func classifyFolderError(message string) string {
+	message = strings.ToLower(message)
+	for _, class := range folderErrorClasses {
+		for _, pattern := range class.patterns {
+			if strings.Contains(message, pattern) {
+				return class.name
+			}
+		}
+	}
+	return "other"
+}
+
+func handleFolderErrors(inst *instance, folderConfig FolderConfig, stats FolderStats) {
+	folderTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}}
+	// db/status counts the errors, so the paths and messages are only
+	// requested for folders that have some.
+	if stats.PullErrors == 0 && stats.Errors == 0 {
+		fields := []field{{"count", 0}}
+		for _, class := range folderErrorClasses {
+			fields = append(fields, field{class.name, 0})
+		}
+		fields = append(fields, field{"other", 0})
+		inst.emit("syncthing_folder_errors", folderTags, fields)
+		return
+	}
+	resp, err := makeRequest(inst, apiPath("rest/folder/errors", url.Values{"folder": {folderConfig.ID}}))
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read errors for %s: %s\n", folderConfig.ID, err)))
+		inst.emit("syncthing_folder_errors", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	defer resp.Body.Close()
+	var folderErrors FolderErrors
+	err = decodeResponse(resp, &folderErrors)
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s\n", err)))
+		inst.emit("syncthing_folder_errors", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	classCounts := make(map[string]int)
+	for _, folderError := range folderErrors.Errors {
+		classCounts[classifyFolderError(folderError.Error)]++
+	}
+	fields := []field{{"count", len(folderErrors.Errors)}}
+	for _, class := range folderErrorClasses {
+		fields = append(fields, field{class.name, classCounts[class.name]})
+	}
+	fields = append(fields, field{"other", classCounts["other"]})
+	inst.emit("syncthing_folder_errors", folderTags, fields)
+	for i, folderError := range folderErrors.Errors {
+		if i >= *folderErrorPathsFlag {
+			break
+		}
+		os.Stderr.Write([]byte(fmt.Sprintf("Folder %s: %s: %s\n", folderConfig.ID, folderError.Path, folderError.Error)))
+	}
+}
+
+// handleFolderNeed emits the number of items being transferred and queued for
+// transfer. db/need has no totals; it pages over progress, queued and rest in
+// that order, so the first page has the in-progress and queued items unless
+// there are more of them than the page size. The rest is derived from the
+// total need count in db/status.
+func handleFolderNeed(inst *instance, folderConfig FolderConfig, stats FolderStats) {
+	folderTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}}
+	resp, err := makeRequest(inst, apiPath("rest/db/need", url.Values{
+		"folder":  {folderConfig.ID},
+		"page":    {"1"},
+		"perpage": {strconv.Itoa(*needPageSizeFlag)},
+	}))
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read needed items for %s: %s\n", folderConfig.ID, err)))
+		inst.emit("syncthing_folder_need", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	defer resp.Body.Close()
+	var need FolderNeed
+	err = decodeResponse(resp, &need)
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s\n", err)))
+		inst.emit("syncthing_folder_need", folderTags, []field{{"collection_ok", 0}})
+		return
+	}
+	rest := stats.NeedTotalItems - int64(len(need.Progress)+len(need.Queued))
+	if rest < 0 {
+		rest = 0
+	}
+	inst.emit("syncthing_folder_need", folderTags, []field{
+		{"progress_items", len(need.Progress)},
+		{"queued_items", len(need.Queued)},
+		{"rest_items", rest},
+	})
+}
+
+func handleFolders(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+	// Without the local device ID, shared_with_devices is left out.
+	myID, myIDErr := localDeviceID(inst)
+	var pausedFolders int
+	var totals folderTotals
+	var folderWg sync.WaitGroup
+	for _, folder := range folderConfig {
+		var sharedWith int
+		for _, device := range folder.Devices {
+			if device.DeviceID != myID {
+				sharedWith++
+			}
+		}
+		if folder.Paused {
+			pausedFolders++
+		}
+		configFields := []field{
+			{"fs_watcher_enabled", boolToInt(folder.FsWatcherEnabled)},
+			{"fs_watcher_delay", folder.FsWatcherDelayS},
+			{"min_disk_free", folder.MinDiskFree.Value},
+			{"copiers", folder.Copiers},
+			{"puller_max_pending_kib", folder.PullerMaxPendingKiB},
+			{"max_conflicts", folder.MaxConflicts},
+		}
+		if myIDErr == nil {
+			configFields = append(configFields, field{"shared_with_devices", sharedWith})
+		}
+		inst.emit("syncthing_folder_config", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}, {"min_disk_free_unit", folder.MinDiskFree.Unit}}, configFields)
+		folderWg.Add(1)
+		go handleFolderStats(inst, folder, &totals, &folderWg)
+	}
+	folderWg.Wait()
+	inst.emit("syncthing_folder_totals", nil, []field{
+		{"number_of_folders", len(folderConfig)},
+		{"paused_folders", pausedFolders},
+		{"need_bytes", totals.needBytes},
+		{"pull_errors", totals.pullErrors},
+		{"global_bytes", totals.globalBytes},
+		{"local_bytes", totals.localBytes},
+		{"errors", totals.errors},
+		{"folders_in_error", totals.foldersInError},
+	})
+	return nil
+}
+
+func handleSystemStatus(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	stats, err := inst.systemStatus()
+	if err != nil {
+		return err
+	}
+	inst.observeUptime(stats.Uptime)
+	inst.emit("syncthing_system", []tag{{"my_id", stats.MyID}}, []field{
+		{"uptime", stats.Uptime},
+		{"goroutines", stats.Goroutines},
+		{"alloc_bytes", stats.Alloc},
+		{"sys_bytes", stats.Sys},
+		{"cpu_percent", stats.CPUPercent},
+		{"discovery_enabled", boolToInt(stats.DiscoveryEnabled)},
+		{"discovery_methods", stats.DiscoveryMethods},
+		{"discovery_errors", len(stats.DiscoveryErrors)},
+	})
+	for method, status := range stats.DiscoveryStatus {
+		inst.emit("syncthing_discovery_method", []tag{{"method", method}}, []field{
+			{"error", boolToInt(status.Error != nil && *status.Error != "")},
+		})
+	}
+	for address, listener := range stats.ConnectionServiceStatus {
+		inst.emit("syncthing_listener", []tag{{"address", address}}, []field{
+			{"ok", boolToInt(listener.Error == nil || *listener.Error == "")},
+			{"lan_addresses", len(listener.LANAddresses)},
+			{"wan_addresses", len(listener.WANAddresses)},
+		})
+	}
+	return nil
+}
+
+func handleVersion(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	resp, err := makeRequest(inst, "rest/system/version")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var version SystemVersion
+	err = decodeResponse(resp, &version)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	inst.emit("syncthing_info", []tag{
+		{"version", version.Version},
+		{"codename", version.Codename},
+		{"os", version.OS},
+		{"arch", version.Arch},
+	}, []field{{"value", 1}})
+	return nil
 }
 
-type FolderStats struct {
-	Errors            int `json:"errors"`
-	GlobalBytes       int `json:"globalBytes"`
-	GlobalDeleted     int `json:"globalDeleted"`
-	GlobalDirectories int `json:"globalDirectories"`
-	GlobalFiles       int `json:"globalFiles"`
-	GlobalSymlinks    int `json:"globalSymlinks"`
-	GlobalTotalItems  int `json:"globalTotalItems"`
-	InSyncBytes       int `json:"inSyncBytes"`
-	InSyncFiles       int `json:"inSyncFiles"`
-	LocalBytes        int `json:"localBytes"`
-	LocalDeleted      int `json:"localDeleted"`
-	LocalDirectories  int `json:"localDirectories"`
-	LocalFiles        int `json:"localFiles"`
-	LocalSymlinks     int `json:"localSymlinks"`
-	LocalTotalItems   int `json:"localTotalItems"`
-	NeedBytes         int `json:"needBytes"`
-	NeedDeletes       int `json:"needDeletes"`
-	NeedDirectories   int `json:"needDirectories"`
-	NeedFiles         int `json:"needFiles"`
-	NeedSymlinks      int `json:"needSymlinks"`
-	NeedTotalItems    int `json:"needTotalItems"`
-	PullErrors        int `json:"pullErrors"`
+func handleSystemErrors(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	resp, err := makeRequest(inst, "rest/system/error")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var systemErrors SystemErrors
+	err = decodeResponse(resp, &systemErrors)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	fields := []field{{"count", len(systemErrors.Errors)}}
+	var latest time.Time
+	for _, systemError := range systemErrors.Errors {
+		if systemError.When.After(latest) {
+			latest = systemError.When
+		}
+	}
+	if !latest.IsZero() {
+		fields = append(fields, field{"last_error_seconds_ago", time.Since(latest).Seconds()})
+	}
+	inst.emit("syncthing_system_errors", nil, fields)
+	return nil
 }
 
-type Report struct {
-	NumFolders     int     `json:"numFolders"`
-	NumDevices     int     `json:"numDevices"`
-	TotalFiles     int     `json:"totFiles"`
-	TotalMiB       int     `json:"totMiB"`
-	MaxFolderMiB   int     `json:"folderMaxMiB"`
-	Sha256Perf     float64 `json:"sha256Perf"`
-	HashPerf       float64 `json:"hashPerf"`
-	Uptime         int     `json:"uptime"`
-	MemoryUsageMiB int     `json:"memoryUsageMiB"`
+// handleLog counts the lines in the Syncthing log. The log only holds the
+// most recent lines, so without a state file the counts are for whatever is
+// still in the buffer.
+func handleLog(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	path := "rest/system/log"
+	var since string
+	inst.updateState(func(instState *instanceState) {
+		since = instState.LogSince
+	})
+	if since != "" {
+		path = apiPath(path, url.Values{"since": {since}})
+	}
+	resp, err := makeRequest(inst, path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var systemLog SystemLog
+	err = decodeResponse(resp, &systemLog)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	var infos, warnings int
+	var latest time.Time
+	for _, message := range systemLog.Messages {
+		switch {
+		case message.Level >= logLevelWarn:
+			warnings++
+		case message.Level == logLevelInfo:
+			infos++
+		}
+		if message.When.After(latest) {
+			latest = message.When
+		}
+	}
+	if !latest.IsZero() {
+		inst.updateState(func(instState *instanceState) {
+			instState.LogSince = latest.Format(time.RFC3339Nano)
+		})
+	}
+	inst.emit("syncthing_log", nil, []field{{"info", infos}, {"warnings", warnings}})
+	return nil
 }
 
-type ConnectionStatItem struct {
-	Address       string    `json:"address"`
-	At            time.Time `json:"at"`
-	ClientVersion string    `json:"clientVersion"`
-	Connected     bool      `json:"connected"`
-	Crypto        string    `json:"crypto"`
-	InBytesTotal  int       `json:"inBytesTotal"`
-	OutBytesTotal int       `json:"outBytesTotal"`
-	Paused        bool      `json:"paused"`
-	Type          string    `json:"type"`
+// Syncthing spreads periodic scans by picking a random interval of up to 5/4
+// of rescanIntervalS, so a scan is only overdue after that.
+const rescanSlack = 1.25
+
+func handleFolderScans(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
+	}
+	folderConfig := config.Folders
+
+	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
+	statsResp, err := makeRequest(inst, "rest/stats/folder")
+	if err != nil {
+		return err
+	}
+	defer statsResp.Body.Close()
+	var stats Folders
+	err = decodeResponse(statsResp, &stats)
+	if err != nil {
+		return fmt.Errorf("invalid response body: %s", err)
+	}
+	for _, folder := range folderConfig {
+		folderStat, ok := stats[folder.ID]
+		if !ok || !cutOffTime.Before(folderStat.LastScan) {
+			// Not scanned since startup.
+			continue
+		}
+		sinceScan := time.Since(folderStat.LastScan)
+		fields := []field{{"last_scan_seconds_ago", sinceScan.Seconds()}}
+		if folder.RescanIntervalS > 0 && !folder.Paused {
+			overdue := sinceScan - time.Duration(float64(folder.RescanIntervalS)*rescanSlack)*time.Second
+			if overdue < 0 {
+				overdue = 0
+			}
+			fields = append(fields, field{"rescan_overdue", boolToInt(overdue > 0)}, field{"rescan_overdue_seconds", overdue.Seconds()})
+		}
+		inst.emit("syncthing_folder_scan", []tag{{"folder_id", folder.ID}, {"folder_label", folder.Label}}, fields)
+	}
+	return nil
 }
 
-type Connections struct {
-	Total       ConnectionStatItem            `json:"total"`
-	Connections map[string]ConnectionStatItem `json:"connections"`
+// clusterCompletion sums up the completion of all folder and device pairs,
+// both in total and per device.
+type clusterCompletion struct {
+	sync.Mutex
+	pairs          int
+	outOfSyncPairs int
+	globalBytes    int64
+	needBytes      int64
+	needItems      int64
+	devices        map[string]*deviceNeed
 }
 
-type DeviceConfig struct {
-	DeviceID        string `json:"deviceID"`
-	Name            string `json:"name"`
+type deviceNeed struct {
+	needBytes int64
+	needItems int64
 }
 
-type DeviceStatItem struct {
-	LastSeen                time.Time `json:"lastSeen"`
-	LastConnectionDurationS float64   `json:"lastConnectionDurationS"`
+func (c *clusterCompletion) add(deviceID string, completion FolderCompletion) {
+	c.Lock()
+	defer c.Unlock()
+	if c.devices == nil {
+		c.devices = make(map[string]*deviceNeed)
+	}
+	device, ok := c.devices[deviceID]
+	if !ok {
+		device = &deviceNeed{}
+		c.devices[deviceID] = device
+	}
+	device.needBytes += completion.NeedBytes
+	device.needItems += completion.NeedItems
+	c.pairs++
+	if completion.Completion < 100 {
+		c.outOfSyncPairs++
+	}
+	c.globalBytes += completion.GlobalBytes
+	c.needBytes += completion.NeedBytes
+	c.needItems += completion.NeedItems
 }
 
-type Devices map[string]DeviceStatItem
+func (c *clusterCompletion) completion() float64 {
+	if c.globalBytes == 0 {
+		return 100
+	}
+	return 100 * float64(c.globalBytes-c.needBytes) / float64(c.globalBytes)
+}
 
-var server = flag.String("server", "http://localhost:8384", "Syncthing API URL")
-var apiKeyFlag = flag.String("apikey", "", "Syncthing API key")
-var useFullReportFlag = flag.Bool("use-full-report", false, "Add extra stats from svc/report. Somewhat slow/heavy.")
+func handleFolderCompletion(inst *instance, folderConfig FolderConfig, deviceID string, cluster *clusterCompletion, wg *sync.WaitGroup) {
+	defer wg.Done()
+	completionTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}, {"device_id", deviceID}}
+	resp, err := makeRequest(inst, apiPath("rest/db/completion", url.Values{"folder": {folderConfig.ID}, "device": {deviceID}}))
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read completion for %s on %s: %s\n", folderConfig.ID, deviceID, err)))
+		inst.emit("syncthing_folder_completion", completionTags, []field{{"collection_ok", 0}})
+		return
+	}
+	defer resp.Body.Close()
+	var completion FolderCompletion
+	err = decodeResponse(resp, &completion)
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s\n", err)))
+		inst.emit("syncthing_folder_completion", completionTags, []field{{"collection_ok", 0}})
+		return
+	}
+	cluster.add(deviceID, completion)
+	inst.emit("syncthing_folder_completion", completionTags, []field{
+		{"completion", completion.Completion},
+		{"global_bytes", completion.GlobalBytes},
+		{"global_items", completion.GlobalItems},
+		{"need_bytes", completion.NeedBytes},
+		{"need_items", completion.NeedItems},
+		{"need_deletes", completion.NeedDeletes},
+		{"remote_state", completion.RemoteState},
+	})
+}
 
-func makeRequest(apiKey string, url string) (*http.Response, error) {
-	client := &http.Client{
-		Timeout: 2 * time.Second,
+func localDeviceID(inst *instance) (string, error) {
+	status, err := inst.systemStatus()
+	if err != nil {
+		return "", err
 	}
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", *server, url), nil)
+	return status.MyID, nil
+}
+
+// sharedFolders returns the folders that are not paused, each with the
+// remote devices (excluding this device) it is shared with.
+func sharedFolders(inst *instance) ([]FolderConfig, error) {
+	myID, err := localDeviceID(inst)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create HTTP request: %s", err)
+		return nil, err
 	}
-	req.Header.Add("X-API-Key", apiKey)
-	resp, err := client.Do(req)
+
+	config, err := inst.config()
 	if err != nil {
-		return nil, fmt.Errorf("HTTP request failed: %s", err)
+		return nil, err
 	}
-	return resp, nil
+	folderConfig := config.Folders
+	var folders []FolderConfig
+	for _, folder := range folderConfig {
+		if folder.Paused {
+			continue
+		}
+		var devices []FolderDeviceConfig
+		for _, device := range folder.Devices {
+			if device.DeviceID != myID {
+				devices = append(devices, device)
+			}
+		}
+		folder.Devices = devices
+		folders = append(folders, folder)
+	}
+	return folders, nil
 }
 
-func handleSystemConnections(apiKey string, wg *sync.WaitGroup) error {
+func handleCompletion(inst *instance, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
-	resp, err := makeRequest(apiKey, "rest/system/connections")
+	folders, err := sharedFolders(inst)
 	if err != nil {
 		return err
 	}
-
-	var stats Connections
-	err = json.NewDecoder(resp.Body).Decode(&stats)
-	if err != nil {
-		return fmt.Errorf("invalid response body: %s", err)
+	var cluster clusterCompletion
+	var completionWg sync.WaitGroup
+	for _, folder := range folders {
+		for _, device := range folder.Devices {
+			completionWg.Add(1)
+			go handleFolderCompletion(inst, folder, device.DeviceID, &cluster, &completionWg)
+		}
 	}
-	numberOfConnections := len(stats.Connections)
-	var paused int
-	if stats.Total.Paused {
-		paused = 1
-	} else {
-		paused = 0
+	completionWg.Wait()
+	inst.emit("syncthing_cluster", nil, []field{
+		{"completion", cluster.completion()},
+		{"need_bytes", cluster.needBytes},
+		{"need_items", cluster.needItems},
+		{"pairs", cluster.pairs},
+		{"out_of_sync_pairs", cluster.outOfSyncPairs},
+	})
+	for deviceID, device := range cluster.devices {
+		inst.emit("syncthing_device_need", []tag{{"device_id", deviceID}}, []field{
+			{"total_need_bytes", device.needBytes},
+			{"total_need_items", device.needItems},
+		})
 	}
-	fmt.Printf("syncthing_connection_totals number_of_connections=%d,in_bytes=%d,out_bytes=%d,paused=%d\n", numberOfConnections, stats.Total.InBytesTotal, stats.Total.OutBytesTotal, paused)
+	return nil
+}
 
-	for connectionId, connectionStat := range stats.Connections {
-		if cutOffTime.Before(connectionStat.At) {
-			// This connection has likely been updated.
-			var connected int
-			var paused int
-			if connectionStat.Paused {
-				paused = 1
-			}
-			if connectionStat.Connected {
-				connected = 1
-			}
-			fmt.Printf("syncthing_connection,client_id=%s connected=%d,paused=%d,in_bytes=%d,out_bytes=%d\n", connectionId, connected, paused, connectionStat.InBytesTotal, connectionStat.OutBytesTotal)
+func handleFolderRemoteNeed(inst *instance, folderConfig FolderConfig, deviceID string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	remoteNeedTags := []tag{{"folder_id", folderConfig.ID}, {"folder_label", folderConfig.Label}, {"device_id", deviceID}}
+	var items int
+	var bytes int64
+	for page := 1; ; page++ {
+		resp, err := makeRequest(inst, apiPath("rest/db/remoteneed", url.Values{
+			"folder":  {folderConfig.ID},
+			"device":  {deviceID},
+			"page":    {strconv.Itoa(page)},
+			"perpage": {strconv.Itoa(remoteNeedPageSize)},
+		}))
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("Unable to read remote need for %s on %s: %s\n", folderConfig.ID, deviceID, err)))
+			inst.emit("syncthing_folder_remote_need", remoteNeedTags, []field{{"collection_ok", 0}})
+			return
+		}
+		var remoteNeed RemoteNeed
+		err = decodeResponse(resp, &remoteNeed)
+		resp.Body.Close()
+		if err != nil {
+			os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s\n", err)))
+			inst.emit("syncthing_folder_remote_need", remoteNeedTags, []field{{"collection_ok", 0}})
+			return
+		}
+		for _, file := range remoteNeed.Files {
+			items++
+			bytes += file.Size
+		}
+		if len(remoteNeed.Files) < remoteNeedPageSize {
+			break
+		}
+	}
+	inst.emit("syncthing_folder_remote_need", remoteNeedTags, []field{
+		{"need_items", items},
+		{"need_bytes", bytes},
+	})
+}
+
+func handleRemoteNeed(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	folders, err := sharedFolders(inst)
+	if err != nil {
+		return err
+	}
+	for _, folder := range folders {
+		for _, device := range folder.Devices {
+			wg.Add(1)
+			go handleFolderRemoteNeed(inst, folder, device.DeviceID, wg)
 		}
 	}
 	return nil
 }
 
-func handleDevices(apiKey string, wg *sync.WaitGroup) error {
+func handlePendingDevices(inst *instance, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resp, err := makeRequest(apiKey, "rest/config/devices")
+	resp, err := makeRequest(inst, "rest/cluster/pending/devices")
 	if err != nil {
 		return err
 	}
-	var deviceConfigs []DeviceConfig
-	err = json.NewDecoder(resp.Body).Decode(&deviceConfigs)
+	defer resp.Body.Close()
+	var pending PendingDevices
+	err = decodeResponse(resp, &pending)
 	if err != nil {
 		return fmt.Errorf("invalid response body: %s", err)
 	}
-
-	var deviceNames = make(map[string]string);
-	for _, device := range deviceConfigs {
-		deviceNames[device.DeviceID] = device.Name;
+	fields := []field{{"count", len(pending)}}
+	var oldest time.Time
+	for _, device := range pending {
+		if oldest.IsZero() || device.Time.Before(oldest) {
+			oldest = device.Time
+		}
 	}
+	if !oldest.IsZero() {
+		fields = append(fields, field{"oldest_seconds_ago", time.Since(oldest).Seconds()})
+	}
+	inst.emit("syncthing_pending_devices", nil, fields)
+	return nil
+}
 
-	var cutOffTime = time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC)
-	resp, err = makeRequest(apiKey, "rest/stats/device")
+func handlePendingFolders(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	resp, err := makeRequest(inst, "rest/cluster/pending/folders")
 	if err != nil {
 		return err
 	}
-
-	var stats Devices
-	err = json.NewDecoder(resp.Body).Decode(&stats)
+	defer resp.Body.Close()
+	var pending PendingFolders
+	err = decodeResponse(resp, &pending)
 	if err != nil {
 		return fmt.Errorf("invalid response body: %s", err)
 	}
-	numberOfDevices := len(stats)
-	fmt.Printf("syncthing_device_totals number_of_devices=%d\n", numberOfDevices)
+	inst.emit("syncthing_pending_folders_totals", nil, []field{{"count", len(pending)}})
+	offered := make(map[string]int)
+	for _, folder := range pending {
+		for deviceId := range folder.OfferedBy {
+			offered[deviceId]++
+		}
+	}
+	for deviceId, count := range offered {
+		inst.emit("syncthing_pending_folders", []tag{{"device_id", deviceId}}, []field{{"count", count}})
+	}
+	return nil
+}
 
-	for deviceId, deviceStat := range stats {
-		if cutOffTime.Before(deviceStat.LastSeen) {
-			fmt.Printf("syncthing_device,device_id=%s,device_name=%s last_seen=%f,last_connection_duration=%f\n",
-				deviceId, strings.Replace(deviceNames[deviceId], " ", "\\ ", -1), deviceStat.LastSeen.Sub(cutOffTime).Seconds(), deviceStat.LastConnectionDurationS)
+func handleDiscovery(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	cache, err := inst.discoveryCache()
+	if err != nil {
+		return err
+	}
+	var withAddresses int
+	for deviceId, entry := range cache {
+		if len(entry.Addresses) > 0 {
+			withAddresses++
 		}
+		inst.emit("syncthing_discovery", []tag{{"device_id", deviceId}}, []field{{"addresses", len(entry.Addresses)}})
 	}
+	inst.emit("syncthing_discovery_totals", nil, []field{
+		{"devices", len(cache)},
+		{"devices_with_addresses", withAddresses},
+	})
 	return nil
 }
 
-func handleFolderStats(apiKey string, folderConfig FolderConfig, wg *sync.WaitGroup) {
+func handleUpgrade(inst *instance, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resp, err := makeRequest(apiKey, fmt.Sprintf("rest/db/status?folder=%s", folderConfig.ID))
+	resp, err := makeRequest(inst, "rest/system/upgrade")
 	if err != nil {
-		os.Stderr.Write([]byte(fmt.Sprintf("Unable to read status for %s: %s", folderConfig.ID, err)))
-		return
+		return err
 	}
-	var stats FolderStats
-	err = json.NewDecoder(resp.Body).Decode(&stats)
+	defer resp.Body.Close()
+	var upgrade UpgradeInfo
+	err = decodeResponse(resp, &upgrade)
 	if err != nil {
-		os.Stderr.Write([]byte(fmt.Sprintf("invalid response body: %s", err)))
-		return
+		return fmt.Errorf("invalid response body: %s", err)
 	}
-	fmt.Printf("syncthing_folder,folder_id=%s,folder_label=%s rescanInterval=%d,errors=%d,global_bytes=%d,global_deleted=%d,global_directories=%d,global_files=%d,global_symlinks=%d,global_total_items=%d,insync_bytes=%d,insync_files=%d,local_bytes=%d,local_deleted=%d,local_directories=%d,local_files=%d,local_symlinks=%d,local_total_items=%d,need_bytes=%d,need_deletes=%d,need_directories=%d,need_files=%d,need_symlinks=%d,need_total_items=%d,pull_errors=%d\n", folderConfig.ID, strings.Replace(folderConfig.Label, " ", "\\ ", -1), folderConfig.RescanIntervalS, stats.Errors, stats.GlobalBytes, stats.GlobalDeleted, stats.GlobalDirectories, stats.GlobalFiles, stats.GlobalSymlinks, stats.GlobalTotalItems, stats.InSyncBytes, stats.InSyncFiles, stats.LocalBytes, stats.LocalDeleted, stats.LocalDirectories, stats.LocalFiles, stats.LocalSymlinks, stats.LocalTotalItems, stats.NeedBytes, stats.NeedDeletes, stats.NeedDirectories, stats.NeedFiles, stats.NeedSymlinks, stats.NeedTotalItems, stats.PullErrors)
+	inst.emit("syncthing_upgrade", []tag{{"running", upgrade.Running}, {"latest", upgrade.Latest}}, []field{
+		{"upgrade_available", boolToInt(upgrade.Newer)},
+		{"major_newer", boolToInt(upgrade.MajorNewer)},
+	})
+	return nil
 }
 
-func handleFolders(apiKey string, wg *sync.WaitGroup) error {
+// handleDialStatus emits the result of the last connection attempt to each
+// configured device, and to each address dialed. Addresses are matched to
+// devices using the configured static addresses and the addresses found by
+// discovery. Syncthing only dials devices that are not connected, so
+// dialed=0 is expected for connected devices.
+func handleDialStatus(inst *instance, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resp, err := makeRequest(apiKey, "rest/config/folders")
+	status, err := inst.systemStatus()
+	if err != nil {
+		return err
+	}
+
+	config, err := inst.config()
 	if err != nil {
 		return err
 	}
-	var folderConfig []FolderConfig
-	err = json.NewDecoder(resp.Body).Decode(&folderConfig)
+	deviceConfigs := config.Devices
+	cache, err := inst.discoveryCache()
 	if err != nil {
-		return fmt.Errorf("invalid response body: %s", err)
+		return err
 	}
-	for _, folder := range folderConfig {
-		wg.Add(1)
-		go handleFolderStats(apiKey, folder, wg)
+
+	addressDevices := make(map[string]string)
+	for deviceId, entry := range cache {
+		for _, address := range entry.Addresses {
+			addressDevices[address] = deviceId
+		}
+	}
+	for _, device := range deviceConfigs {
+		for _, address := range device.Addresses {
+			addressDevices[address] = device.DeviceID
+		}
+	}
+
+	type deviceDial struct {
+		when    time.Time
+		ok      bool
+		dialed  int
+		failing int
+	}
+	deviceDials := make(map[string]*deviceDial)
+	for address, dial := range status.LastDialStatus {
+		ok := dial.Error == nil || *dial.Error == ""
+		fields := []field{{"dial_ok", boolToInt(ok)}}
+		if !dial.When.IsZero() {
+			fields = append(fields, field{"seconds_since_attempt", time.Since(dial.When).Seconds()})
+		}
+		deviceId := addressDevices[address]
+		inst.emit("syncthing_dial_address", []tag{{"address", address}, {"device_id", deviceId}}, fields)
+		if deviceId == "" {
+			continue
+		}
+		device, found := deviceDials[deviceId]
+		if !found {
+			device = &deviceDial{}
+			deviceDials[deviceId] = device
+		}
+		device.dialed++
+		if !ok {
+			device.failing++
+		}
+		if !found || dial.When.After(device.when) {
+			device.when = dial.When
+			device.ok = ok
+		}
+	}
+
+	deviceNames := uniqueDeviceNames(deviceConfigs)
+	for _, device := range deviceConfigs {
+		if device.DeviceID == status.MyID || device.Paused {
+			continue
+		}
+		deviceTags := []tag{{"device_id", device.DeviceID}, {"device_name", deviceNames[device.DeviceID]}}
+		dial, found := deviceDials[device.DeviceID]
+		if !found {
+			inst.emit("syncthing_dial", deviceTags, []field{{"dialed", 0}})
+			continue
+		}
+		fields := []field{
+			{"dialed", 1},
+			{"dial_ok", boolToInt(dial.ok)},
+			{"addresses_dialed", dial.dialed},
+			{"addresses_failing", dial.failing},
+		}
+		if !dial.when.IsZero() {
+			fields = append(fields, field{"seconds_since_attempt", time.Since(dial.when).Seconds()})
+		}
+		inst.emit("syncthing_dial", deviceTags, fields)
+	}
+	return nil
+}
+
+func handleOptions(inst *instance, wg *sync.WaitGroup) error {
+	defer wg.Done()
+	config, err := inst.config()
+	if err != nil {
+		return err
 	}
+	options := config.Options
+	inst.emit("syncthing_options", nil, []field{
+		{"global_discovery_enabled", boolToInt(options.GlobalAnnounceEnabled)},
+		{"local_discovery_enabled", boolToInt(options.LocalAnnounceEnabled)},
+		{"relays_enabled", boolToInt(options.RelaysEnabled)},
+		{"nat_enabled", boolToInt(options.NATEnabled)},
+		{"max_send_kbps", options.MaxSendKbps},
+		{"max_recv_kbps", options.MaxRecvKbps},
+		{"crash_reporting_enabled", boolToInt(options.CrashReportingEnabled)},
+		// Positive when usage reporting is accepted, -1 when declined.
+		{"usage_reporting_accepted", options.URAccepted},
+	})
 	return nil
 }
 
-func handleReport(apiKey string, wg *sync.WaitGroup) error {
+func handleReport(inst *instance, wg *sync.WaitGroup) error {
 	defer wg.Done()
-	resp, err := makeRequest(apiKey, "rest/svc/report")
+	resp, err := makeRequest(inst, "rest/svc/report")
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 	var stats Report
-	err = json.NewDecoder(resp.Body).Decode(&stats)
+	err = decodeResponse(resp, &stats)
 	if err != nil {
 		return fmt.Errorf("invalid response body: %s", err)
 	}
-	fmt.Printf("syncthing_report num_folders=%d,num_devices=%d,total_files=%d,total_mib=%d,max_folder_mib=%d,sha256perf=%f,hashperf=%f,uptime=%d,memory_usage_mib=%d\n", stats.NumFolders, stats.NumDevices, stats.TotalFiles, stats.TotalMiB, stats.MaxFolderMiB, stats.Sha256Perf, stats.HashPerf, stats.Uptime, stats.MemoryUsageMiB)
+	inst.emit("syncthing_report", nil, []field{
+		{"num_folders", stats.NumFolders},
+		{"num_devices", stats.NumDevices},
+		{"total_files", stats.TotalFiles},
+		{"total_mib", stats.TotalMiB},
+		{"max_folder_mib", stats.MaxFolderMiB},
+		{"sha256perf", stats.Sha256Perf},
+		{"hashperf", stats.HashPerf},
+		{"uptime", stats.Uptime},
+		{"memory_usage_mib", stats.MemoryUsageMiB},
+	})
+
+	var customRescanIntervals int
+	for _, interval := range stats.RescanIntervals {
+		if interval != defaultRescanIntervalS {
+			customRescanIntervals++
+		}
+	}
+	features := []field{
+		{"folder_sendonly", stats.FolderUses.SendOnly},
+		{"folder_sendreceive", stats.FolderUses.SendReceive},
+		{"folder_receiveonly", stats.FolderUses.ReceiveOnly},
+		{"folder_ignore_perms", stats.FolderUses.IgnorePerms},
+		{"folder_ignore_delete", stats.FolderUses.IgnoreDelete},
+		{"folder_auto_normalize", stats.FolderUses.AutoNormalize},
+		{"folder_simple_versioning", stats.FolderUses.SimpleVersioning},
+		{"folder_external_versioning", stats.FolderUses.ExternalVersioning},
+		{"folder_staggered_versioning", stats.FolderUses.StaggeredVersioning},
+		{"folder_trashcan_versioning", stats.FolderUses.TrashcanVersioning},
+		{"folder_fs_watcher_enabled", stats.FolderUsesV3.FsWatcherEnabled},
+		{"folder_scan_progress_disabled", stats.FolderUsesV3.ScanProgressDisabled},
+		{"folder_conflicts_disabled", stats.FolderUsesV3.ConflictsDisabled},
+		{"folder_conflicts_unlimited", stats.FolderUsesV3.ConflictsUnlimited},
+		{"folder_disable_temp_indexes", stats.FolderUsesV3.DisableTempIndexes},
+		{"folder_custom_rescan_interval", customRescanIntervals},
+		{"device_introducer", stats.DeviceUses.Introducer},
+		{"device_custom_cert_name", stats.DeviceUses.CustomCertName},
+		{"device_compress_always", stats.DeviceUses.CompressAlways},
+		{"device_compress_metadata", stats.DeviceUses.CompressMetadata},
+		{"device_compress_never", stats.DeviceUses.CompressNever},
+		{"device_dynamic_addr", stats.DeviceUses.DynamicAddr},
+		{"device_static_addr", stats.DeviceUses.StaticAddr},
+		{"ignore_lines", stats.IgnoreStats.Lines},
+		{"ignore_inverts", stats.IgnoreStats.Inverts},
+		{"ignore_folded", stats.IgnoreStats.Folded},
+		{"ignore_deletable", stats.IgnoreStats.Deletable},
+		{"ignore_rooted", stats.IgnoreStats.Rooted},
+		{"ignore_includes", stats.IgnoreStats.Includes},
+		{"ignore_double_stars", stats.IgnoreStats.DoubleStars},
+		{"ignore_stars", stats.IgnoreStats.Stars},
+		{"announce_global_enabled", boolToInt(stats.Announce.GlobalEnabled)},
+		{"announce_local_enabled", boolToInt(stats.Announce.LocalEnabled)},
+		{"announce_default_servers_dns", stats.Announce.DefaultServersDNS},
+		{"announce_default_servers_ip", stats.Announce.DefaultServersIP},
+		{"announce_other_servers", stats.Announce.OtherServers},
+		{"relays_enabled", boolToInt(stats.Relays.Enabled)},
+		{"relays_default_servers", stats.Relays.DefaultServers},
+		{"relays_other_servers", stats.Relays.OtherServers},
+		{"uses_rate_limit", boolToInt(stats.UsesRateLimit)},
+		{"upgrade_allowed_manual", boolToInt(stats.UpgradeAllowedManual)},
+		{"upgrade_allowed_auto", boolToInt(stats.UpgradeAllowedAuto)},
+	}
+	var transports []string
+	for transport := range stats.TransportStats {
+		transports = append(transports, transport)
+	}
+	sort.Strings(transports)
+	for _, transport := range transports {
+		features = append(features, field{"transport_" + strings.Replace(transport, "-", "_", -1), stats.TransportStats[transport]})
+	}
+	inst.emit("syncthing_report_features", nil, features)
 	return nil
 }
 
-func wrapHandler(handler func(string, *sync.WaitGroup) error, apiKey string, wg *sync.WaitGroup) {
-	err := handler(apiKey, wg)
+// handler collects one group of measurements. When collect fails, the
+// measurement is emitted with only collection_ok=0, so that a failure can be
+// told apart from zero values.
+type handler struct {
+	measurement string
+	collect     func(*instance, *sync.WaitGroup) error
+}
+
+func wrapHandler(h handler, inst *instance, wg *sync.WaitGroup) {
+	err := h.collect(inst, wg)
 	if err != nil {
-		os.Stderr.Write([]byte(fmt.Sprintf("Failed: %s", err)))
+		os.Stderr.Write([]byte(fmt.Sprintf("Failed: %s: %s\n", inst.server(), err)))
+		inst.emit(h.measurement, nil, []field{{"collection_ok", 0}})
+	}
+}
+
+// collectInstance runs all handlers against an instance, unless its health
+// check fails, in which case only syncthing_up is emitted.
+func collectInstance(inst *instance, handlers []handler) {
+	// Alerts are also sent when Syncthing is down.
+	defer inst.sendAlerts()
+	if *instanceTimeoutFlag > 0 {
+		var cancel context.CancelFunc
+		inst.ctx, cancel = context.WithTimeout(context.Background(), *instanceTimeoutFlag)
+		defer cancel()
+	}
+	if !checkHealth(inst) {
+		return
+	}
+	inst.summaryMode = summaryMode(inst)
+	var instanceWg sync.WaitGroup
+	for _, h := range handlers {
+		instanceWg.Add(1)
+		go wrapHandler(h, inst, &instanceWg)
+	}
+	instanceWg.Wait()
+	if *useEventsFlag {
+		inst.emitEvents()
+	}
+	inst.emitRequestStats()
+	if inst.summaryMode {
+		inst.emitOffenders()
+	}
+	if *onlyChangedFlag {
+		inst.pruneSeries()
 	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dashboard" {
+		os.Exit(runDashboard(os.Args[2:]))
+	}
 
 	flag.Parse()
-	if *apiKeyFlag == "" {
+	if *versionFlag {
+		fmt.Printf("syncthing_stats %s (%s)\n", version, commit)
+		os.Exit(0)
+	}
+	// With Kubernetes discovery the API keys may come from secrets instead.
+	if *apiKeyFlag == "" && *discoverK8sSelectorFlag == "" && *userFlag == "" {
 		fmt.Println("Invalid API key")
 		os.Exit(1)
 	}
+	if *folderTagFlag != "id" && *folderTagFlag != "label" && *folderTagFlag != "both" {
+		fmt.Println("Invalid folder tag")
+		os.Exit(1)
+	}
+	if *outputFormatFlag != "influx" && *outputFormatFlag != "json" {
+		fmt.Println("Invalid output format")
+		os.Exit(1)
+	}
+	if *deviceIDFormatFlag != "full" && *deviceIDFormatFlag != "short" && *deviceIDFormatFlag != "both" {
+		fmt.Println("Invalid device ID format")
+		os.Exit(1)
+	}
+	if _, ok := byteUnits[*byteUnitFlag]; !ok {
+		fmt.Println("Invalid byte unit")
+		os.Exit(1)
+	}
+	if *onlyChangedFlag && *stateFileFlag == "" {
+		fmt.Println("-only-changed requires -state-file")
+		os.Exit(1)
+	}
+	if *useEventAPIFlag && *stateFileFlag == "" {
+		fmt.Println("-use-event-api requires -state-file")
+		os.Exit(1)
+	}
+	if len(alertRulesFlag) > 0 && *stateFileFlag == "" {
+		fmt.Println("-alert-rule requires -state-file")
+		os.Exit(1)
+	}
+	if *alertWebhookFlag != "" {
+		alertNotifiers = append(alertNotifiers, sendWebhook)
+	}
+	if *alertSMTPServerFlag != "" {
+		if *alertSMTPFromFlag == "" || *alertSMTPToFlag == "" {
+			fmt.Println("-alert-smtp-server requires -alert-smtp-from and -alert-smtp-to")
+			os.Exit(1)
+		}
+		err := parseSMTPTemplates()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		alertNotifiers = append(alertNotifiers, sendEmail)
+	}
+	if *alertPagerDutyKeyFlag != "" {
+		alertNotifiers = append(alertNotifiers, sendPagerDuty)
+	}
+	if *alertOpsgenieKeyFlag != "" {
+		alertNotifiers = append(alertNotifiers, sendOpsgenie)
+	}
+	if *alertNtfyFlag != "" {
+		alertNotifiers = append(alertNotifiers, sendNtfy)
+	}
+	if *alertGotifyFlag != "" {
+		if *alertGotifyTokenFlag == "" {
+			fmt.Println("-alert-gotify requires -alert-gotify-token")
+			os.Exit(1)
+		}
+		alertNotifiers = append(alertNotifiers, sendGotify)
+	}
+	if len(alertRulesFlag) > 0 && len(alertNotifiers) == 0 {
+		fmt.Println("-alert-rule requires a notifier such as -alert-webhook, -alert-smtp-server or -alert-ntfy")
+		os.Exit(1)
+	}
+	if *useDownloadProgressFlag && !*useEventAPIFlag {
+		fmt.Println("-use-download-progress requires -use-event-api")
+		os.Exit(1)
+	}
+	if *useEventsFlag && *stateFileFlag == "" {
+		fmt.Println("-use-events requires -state-file")
+		os.Exit(1)
+	}
+	if *workersFlag < 1 {
+		fmt.Println("Invalid number of workers")
+		os.Exit(1)
+	}
+	tlsConfig, err := makeTLSConfig(*tlsMinVersionFlag, *tlsCipherSuitesFlag)
+	if err != nil {
+		fmt.Printf("Invalid TLS configuration: %s\n", err)
+		os.Exit(1)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	// The transport asks for gzip and decompresses responses by itself,
+	// which helps with large responses over slow links.
+	transport.DisableCompression = *disableCompressionFlag
+	httpClient.Transport = transport
+
+	err = loadState()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	instances, err := discoverInstances(*apiKeyFlag)
+	if err != nil {
+		fmt.Printf("Instance discovery failed: %s\n", err)
+		os.Exit(1)
+	}
+	for _, inst := range instances {
+		inst.user, inst.password = *userFlag, *passwordFlag
+	}
+
 	var wg sync.WaitGroup
 
-	allHandlers := []func(string, *sync.WaitGroup) error{handleFolders, handleSystemConnections, handleDevices}
+	allHandlers := []handler{
+		{"syncthing_folder_totals", handleFolders},
+		{"syncthing_connection_totals", handleSystemConnections},
+		{"syncthing_device_totals", handleDevices},
+		{"syncthing_system", handleSystemStatus},
+		{"syncthing_info", handleVersion},
+		{"syncthing_system_errors", handleSystemErrors},
+		{"syncthing_folder_scan", handleFolderScans},
+		{"syncthing_pending_devices", handlePendingDevices},
+		{"syncthing_pending_folders_totals", handlePendingFolders},
+		{"syncthing_discovery_totals", handleDiscovery},
+		{"syncthing_dial", handleDialStatus},
+		{"syncthing_options", handleOptions},
+	}
 	if *useFullReportFlag {
-		allHandlers = append(allHandlers, handleReport)
+		allHandlers = append(allHandlers, handler{"syncthing_report", handleReport})
+	}
+	if *useUpgradeCheckFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_upgrade", handleUpgrade})
+	}
+	if *useCompletionFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_cluster", handleCompletion})
+	}
+	if *useRemoteNeedFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_folder_remote_need", handleRemoteNeed})
+	}
+	if *useLogFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_log", handleLog})
+	}
+	if *useConflictsFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_folder_conflicts", handleConflicts})
+	}
+	if *useDiskUsageFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_folder_disk", handleDiskUsage})
 	}
-	for _, handler := range allHandlers {
+	if *useMarkerCheckFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_folder_marker", handleMarkerCheck})
+	}
+	if *useVersionsSizeFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_folder_versions", handleVersionsSize})
+	}
+	if *useEventAPIFlag {
+		allHandlers = append(allHandlers, handler{"syncthing_event_api", handleEventAPI})
+	}
+	// A bounded number of workers collect from the instances, so that
+	// discovering many instances does not open connections to all at once.
+	queue := make(chan *instance)
+	for i := 0; i < *workersFlag && i < len(instances); i++ {
 		wg.Add(1)
-		go wrapHandler(handler, *apiKeyFlag, &wg)
+		go func() {
+			defer wg.Done()
+			for inst := range queue {
+				collectInstance(inst, allHandlers)
+			}
+		}()
 	}
+	for _, inst := range instances {
+		queue <- inst
+	}
+	close(queue)
 	wg.Wait()
+	writeMeasurement("syncthing_collector_info", []tag{{"version", version}, {"commit", commit}}, []field{{"value", 1}})
+	flushOutput()
+
+	err = saveState()
+	if err != nil {
+		os.Stderr.Write([]byte(fmt.Sprintf("%s\n", err)))
+	}
 }
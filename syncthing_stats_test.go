@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestMakeTLSConfig(t *testing.T) {
+	tests := []struct {
+		minVersion   string
+		cipherSuites string
+		wantVersion  uint16
+		wantSuites   []uint16
+		err          bool
+	}{
+		{},
+		{minVersion: "1.2", wantVersion: tls.VersionTLS12},
+		{minVersion: "1.3", wantVersion: tls.VersionTLS13},
+		{
+			minVersion:   "1.2",
+			cipherSuites: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+			wantVersion:  tls.VersionTLS12,
+			wantSuites:   []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		{minVersion: "1.4", err: true},
+		{minVersion: "TLS1.2", err: true},
+		{cipherSuites: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_NO_SUCH_SUITE", err: true},
+	}
+	for _, test := range tests {
+		config, err := makeTLSConfig(test.minVersion, test.cipherSuites)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q, %q: no error", test.minVersion, test.cipherSuites)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q, %q: %s", test.minVersion, test.cipherSuites, err)
+			continue
+		}
+		if config.MinVersion != test.wantVersion || !reflect.DeepEqual(config.CipherSuites, test.wantSuites) {
+			t.Errorf("%q, %q: got version %x and suites %v, want %x and %v", test.minVersion, test.cipherSuites, config.MinVersion, config.CipherSuites, test.wantVersion, test.wantSuites)
+		}
+	}
+}
+
+func TestUniqueDeviceNames(t *testing.T) {
+	devices := []DeviceConfig{
+		{DeviceID: "AAAAAAA-1111111", Name: "laptop"},
+		{DeviceID: "BBBBBBB-2222222", Name: "nas"},
+		{DeviceID: "CCCCCCC-3333333", Name: "nas"},
+		{DeviceID: "DDDDDDD-4444444", Name: ""},
+		{DeviceID: "EEE", Name: ""},
+	}
+	want := map[string]string{
+		"AAAAAAA-1111111": "laptop",
+		"BBBBBBB-2222222": "nas (BBBBBBB)",
+		"CCCCCCC-3333333": "nas (CCCCCCC)",
+		"DDDDDDD-4444444": "DDDDDDD",
+		"EEE":             "EEE",
+	}
+	if got := uniqueDeviceNames(devices); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+var byteUnitFlag = flag.String("byte-unit", "B", "Unit of byte fields: B, KiB, MiB or GiB. Fields other than B are floats with the _bytes suffix replaced by _kib, _mib or _gib.")
+
+var byteUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+// isByteField tells whether a field holds a number of bytes.
+func isByteField(key string) bool {
+	return key == "bytes" || strings.HasSuffix(key, "_bytes")
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// scaleByteFields applies -byte-unit to the byte fields.
+func scaleByteFields(fields []field) []field {
+	if *byteUnitFlag == "B" {
+		return fields
+	}
+	divisor := byteUnits[*byteUnitFlag]
+	suffix := strings.ToLower(*byteUnitFlag)
+	scaled := make([]field, len(fields))
+	for i, f := range fields {
+		value, ok := toFloat(f.value)
+		if !ok || !isByteField(f.key) {
+			scaled[i] = f
+			continue
+		}
+		key := strings.TrimSuffix(strings.TrimSuffix(f.key, "bytes"), "_")
+		if key == "" {
+			key = suffix
+		} else {
+			key += "_" + suffix
+		}
+		scaled[i] = field{key, value / divisor}
+	}
+	return scaled
+}
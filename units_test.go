@@ -0,0 +1,32 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScaleByteFields(t *testing.T) {
+	defer func(unit string) { *byteUnitFlag = unit }(*byteUnitFlag)
+	fields := []field{
+		{"need_bytes", int64(3 << 20)},
+		{"bytes", uint64(1 << 30)},
+		{"total_bytes", 512},
+		{"need_files", 7},
+		{"state_bytes", "unknown"},
+	}
+	tests := []struct {
+		unit string
+		want []field
+	}{
+		{"B", fields},
+		{"KiB", []field{{"need_kib", 3072.0}, {"kib", 1048576.0}, {"total_kib", 0.5}, {"need_files", 7}, {"state_bytes", "unknown"}}},
+		{"MiB", []field{{"need_mib", 3.0}, {"mib", 1024.0}, {"total_mib", 512.0 / (1 << 20)}, {"need_files", 7}, {"state_bytes", "unknown"}}},
+		{"GiB", []field{{"need_gib", 3.0 / 1024}, {"gib", 1.0}, {"total_gib", 512.0 / (1 << 30)}, {"need_files", 7}, {"state_bytes", "unknown"}}},
+	}
+	for _, test := range tests {
+		*byteUnitFlag = test.unit
+		if got := scaleByteFields(fields); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.unit, got, test.want)
+		}
+	}
+}